@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an append-only file that is renamed to path.1 and
+// started afresh once it would grow past maxBytes.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxBytes int64) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write appends b as a single unit, so concurrent lines never interleave.
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// withAccessLog writes one Combined Log Format line per request to out.
+func withAccessLog(out *rotatingFile, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		user := "-"
+		if u, _, ok := r.BasicAuth(); ok && u != "" {
+			user = u
+		}
+		fmt.Fprintf(out, "%s - %s [%s] %s %d %d %s %s\n",
+			remoteIP(r),
+			user,
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto),
+			status,
+			rw.bytes,
+			strconv.Quote(orDash(r.Referer())),
+			strconv.Quote(orDash(r.UserAgent())),
+		)
+	})
+}
+
+func orDash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return v
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sync/atomic"
+)
+
+// requireAdminToken lets through only requests whose X-Admin-Token header
+// matches token.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "missing or invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cacheFlushHandler empties every named cache and reports how many entries
+// each held.
+func cacheFlushHandler(caches map[string]*responseCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "only POST is supported")
+			return
+		}
+		evicted := make(map[string]int, len(caches))
+		total := 0
+		for name, c := range caches {
+			n := c.Flush()
+			evicted[name] = n
+			total += n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"evicted": total, "caches": evicted})
+	}
+}
+
+// configHandler reports the effective configuration as JSON, as of the
+// last reload.
+func configHandler(cfg *atomic.Pointer[Config]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "only GET and HEAD are supported")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(cfg.Load().effective())
+	}
+}
+
+// pprofHandler serves the runtime profiles under /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamCooldown is how long a target that refused a connection is
+// skipped before it is tried again.
+const upstreamCooldown = 10 * time.Second
+
+// upstreamPool round-robins requests across equivalent upstream targets,
+// skipping targets that recently failed to connect.
+type upstreamPool struct {
+	targets   []string
+	next      atomic.Uint64
+	downUntil []atomic.Int64 // unix nanoseconds
+	cooldown  time.Duration
+}
+
+func newUpstreamPool(targets []string, cooldown time.Duration) *upstreamPool {
+	return &upstreamPool{
+		targets:   targets,
+		downUntil: make([]atomic.Int64, len(targets)),
+		cooldown:  cooldown,
+	}
+}
+
+// order returns target indexes to try for one request: healthy targets in
+// round-robin order, then targets still cooling down as a last resort.
+func (p *upstreamPool) order() []int {
+	n := len(p.targets)
+	start := int(p.next.Add(1)-1) % n
+	now := time.Now().UnixNano()
+	healthy := make([]int, 0, n)
+	var down []int
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		if p.downUntil[idx].Load() > now {
+			down = append(down, idx)
+		} else {
+			healthy = append(healthy, idx)
+		}
+	}
+	return append(healthy, down...)
+}
+
+func (p *upstreamPool) markDown(idx int) {
+	p.downUntil[idx].Store(time.Now().Add(p.cooldown).UnixNano())
+}
+
+// targetURL is target with the query of the outbound request.
+func targetURL(target, rawQuery string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = rawQuery
+	return u, nil
+}
+
+// isConnectError reports whether err happened before a connection to the
+// upstream was established, so another target can safely be tried.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func countingBackend(hits *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+}
+
+func TestPoolRoundRobins(t *testing.T) {
+	var hitsA, hitsB atomic.Int32
+	a, b := countingBackend(&hitsA), countingBackend(&hitsB)
+	defer a.Close()
+	defer b.Close()
+	p := newTestProxy(a.URL)
+	p.Pool = newUpstreamPool([]string{a.URL, b.URL}, time.Minute)
+
+	for range 10 {
+		if rec := get(p.Handler(), "/api/nearest", nil); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	}
+	if hitsA.Load() != 5 || hitsB.Load() != 5 {
+		t.Errorf("hits = %d and %d, want 5 each", hitsA.Load(), hitsB.Load())
+	}
+}
+
+func TestPoolFailsOverOnConnectionError(t *testing.T) {
+	var hits atomic.Int32
+	up := countingBackend(&hits)
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	p := newTestProxy(down.URL)
+	p.Pool = newUpstreamPool([]string{down.URL, up.URL}, time.Minute)
+
+	for i := range 4 {
+		if rec := get(p.Handler(), "/api/nearest", nil); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, rec.Code)
+		}
+	}
+	if got := hits.Load(); got != 4 {
+		t.Errorf("healthy backend hit %d times, want 4", got)
+	}
+	if order := p.Pool.order(); order[0] != 1 {
+		t.Errorf("order = %v, want the failed target last", order)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// bbox is a bounding box in degrees. When minLng > maxLng the box crosses
+// the antimeridian.
+type bbox struct {
+	minLng, minLat, maxLng, maxLat float64
+}
+
+// parseBBox parses bbox=minLng,minLat,maxLng,maxLat.
+func parseBBox(raw string) (bbox, bool) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 4 {
+		return bbox{}, false
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bbox{}, false
+		}
+		v[i] = f
+	}
+	b := bbox{minLng: v[0], minLat: v[1], maxLng: v[2], maxLat: v[3]}
+	for _, lng := range []float64{b.minLng, b.maxLng} {
+		if lng < -180 || lng > 180 {
+			return bbox{}, false
+		}
+	}
+	if b.minLat < -90 || b.maxLat > 90 || b.minLat > b.maxLat {
+		return bbox{}, false
+	}
+	return b, true
+}
+
+func (b bbox) contains(lat, lng float64) bool {
+	if lat < b.minLat || lat > b.maxLat {
+		return false
+	}
+	if b.minLng <= b.maxLng {
+		return lng >= b.minLng && lng <= b.maxLng
+	}
+	return lng >= b.minLng || lng <= b.maxLng
+}
+
+// bboxTransformer drops nearest results outside
+// bbox=minLng,minLat,maxLng,maxLat. The query is validated beforehand, so
+// a bad box never gets here.
+type bboxTransformer struct{}
+
+func (bboxTransformer) Param() string { return "bbox" }
+
+func (bboxTransformer) Transform(r *http.Request, body []byte, _ http.Header) ([]byte, error) {
+	box, ok := parseBBox(r.URL.Query().Get("bbox"))
+	if !ok {
+		return body, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	// A single parking outside the box becomes null, like no result.
+	if wrapper, ok := doc.(map[string]any); ok {
+		if parking, ok := wrapper["parking"]; ok {
+			switch parking := parking.(type) {
+			case map[string]any:
+				if !box.keeps(parking) {
+					wrapper["parking"] = nil
+				}
+			case []any:
+				wrapper["parking"] = box.filter(parking)
+			}
+			return json.Marshal(wrapper)
+		}
+	}
+	if items, ok := doc.([]any); ok {
+		doc = box.filter(items)
+	}
+	return json.Marshal(doc)
+}
+
+func (b bbox) filter(items []any) []any {
+	kept := make([]any, 0, len(items))
+	for _, item := range items {
+		if obj, ok := item.(map[string]any); !ok || b.keeps(obj) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// keeps reports whether a result lies in the box. Results without
+// recognisable coordinates are kept.
+func (b bbox) keeps(obj map[string]any) bool {
+	lat, lng, ok := resultPosition(obj)
+	return !ok || b.contains(lat, lng)
+}
+
+// resultPosition reads a result's position from "coordinates": "lat, lng",
+// as the parser returns it, or from numeric lat/lng fields.
+func resultPosition(obj map[string]any) (lat, lng float64, ok bool) {
+	if s, isString := obj["coordinates"].(string); isString {
+		latRaw, lngRaw, found := strings.Cut(s, ",")
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(latRaw), 64)
+		lng, err2 := strconv.ParseFloat(strings.TrimSpace(lngRaw), 64)
+		return lat, lng, found && err1 == nil && err2 == nil
+	}
+	for _, names := range [][2]string{{"lat", "lng"}, {"latitude", "longitude"}} {
+		latNum, ok1 := obj[names[0]].(json.Number)
+		lngNum, ok2 := obj[names[1]].(json.Number)
+		if !ok1 || !ok2 {
+			continue
+		}
+		lat, err1 := latNum.Float64()
+		lng, err2 := lngNum.Float64()
+		return lat, lng, err1 == nil && err2 == nil
+	}
+	return 0, 0, false
+}
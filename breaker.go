@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker opens after threshold consecutive failures and rejects
+// calls until cooldown has passed, then lets a single probe through.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a call may proceed. A nil breaker allows all calls.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// abort releases a half-open probe slot for a call the client abandoned,
+// without counting it either way.
+func (b *circuitBreaker) abort() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) setState(s breakerState) {
+	slog.Warn("circuit breaker state change", "upstream", b.name, "from", b.state.String(), "to", s.String(), "failures", b.failures)
+	b.state = s
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"io"
+	"sort"
+)
+
+// The standard library has no Brotli encoder and the gateway builds
+// without third-party packages, so brotliWriter is a small one (RFC 7932):
+// greedy LZ77 over hash chains and one prefix code per alphabet in each
+// meta-block. It compresses less than the reference encoder, as it uses
+// neither context modelling nor the static dictionary, but any Brotli
+// decoder reads its output.
+
+const (
+	// brotliWindowBits is the window the stream header declares. Matches
+	// never reach back further than brotliBlockSize, which fits in it.
+	brotliWindowBits = 18
+	// brotliBlockSize is the most input one meta-block holds.
+	brotliBlockSize = 1 << 16
+	brotliHashBits  = 15
+	brotliMinMatch  = 4
+
+	brotliLiteralAlphabet  = 256
+	brotliCommandAlphabet  = 704
+	brotliDistanceAlphabet = 64 // 16 + NDIRECT + 48<<NPOSTFIX, both zero
+)
+
+// Insert and copy length codes: the first length each covers and how many
+// extra bits follow it.
+var (
+	brotliInsertBase  = [24]uint32{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	brotliInsertExtra = [24]uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	brotliCopyBase    = [24]uint32{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	brotliCopyExtra   = [24]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+)
+
+// brotliWriter compresses what is written to it into w. Output reaches w
+// when a meta-block fills up, on Flush and on Close.
+type brotliWriter struct {
+	w io.Writer
+	// depth is how many earlier positions are tried for each match.
+	depth   int
+	pending []byte
+	bits    bitWriter
+	started bool
+	closed  bool
+	err     error
+}
+
+// newBrotliWriter returns a writer compressing at level, 1 (fastest) to 9.
+func newBrotliWriter(w io.Writer, level int) *brotliWriter {
+	return &brotliWriter{w: w, depth: 1 << (min(max(level, 1), 9) - 1)}
+}
+
+func (b *brotliWriter) Write(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		take := min(len(p), brotliBlockSize-len(b.pending))
+		b.pending = append(b.pending, p[:take]...)
+		p = p[take:]
+		if len(b.pending) == brotliBlockSize {
+			b.metaBlock()
+			if err := b.emit(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Flush writes out everything written so far, ending on a byte boundary
+// with an empty metadata block.
+func (b *brotliWriter) Flush() error {
+	if b.err != nil {
+		return b.err
+	}
+	b.metaBlock()
+	if b.bits.n > 0 {
+		b.bits.write(1, 0) // ISLAST
+		b.bits.write(2, 3) // MNIBBLES: metadata
+		b.bits.write(1, 0) // reserved
+		b.bits.write(2, 0) // MSKIPBYTES
+		b.bits.align()
+	}
+	return b.emit()
+}
+
+// Close writes out the rest of the stream and its last meta-block. It
+// does not close w.
+func (b *brotliWriter) Close() error {
+	if b.closed || b.err != nil {
+		return b.err
+	}
+	b.closed = true
+	b.metaBlock()
+	b.header()
+	b.bits.write(1, 1) // ISLAST
+	b.bits.write(1, 1) // ISLASTEMPTY
+	b.bits.align()
+	return b.emit()
+}
+
+func (b *brotliWriter) emit() error {
+	if len(b.bits.buf) == 0 {
+		return nil
+	}
+	_, b.err = b.w.Write(b.bits.buf)
+	b.bits.buf = b.bits.buf[:0]
+	return b.err
+}
+
+// header writes the stream header before the first meta-block.
+func (b *brotliWriter) header() {
+	if !b.started {
+		b.started = true
+		b.bits.write(4, (brotliWindowBits-17)<<1|1)
+	}
+}
+
+// metaBlock encodes the pending input as one meta-block, stored
+// uncompressed when compressing does not make it smaller.
+func (b *brotliWriter) metaBlock() {
+	data := b.pending
+	if len(data) == 0 {
+		return
+	}
+	b.pending = b.pending[:0]
+	b.header()
+
+	var compressed bitWriter
+	writeMetaBlockHeader(&compressed, len(data))
+	compressed.write(1, 0) // ISUNCOMPRESSED
+	compressCommands(&compressed, data, findCommands(data, b.depth))
+	if len(compressed.buf)+1 < len(data) {
+		b.bits.appendBits(&compressed)
+		return
+	}
+	writeMetaBlockHeader(&b.bits, len(data))
+	b.bits.write(1, 1) // ISUNCOMPRESSED
+	b.bits.align()
+	b.bits.buf = append(b.bits.buf, data...)
+}
+
+// writeMetaBlockHeader writes ISLAST, unset, and the meta-block length in
+// as few nibbles as it takes.
+func writeMetaBlockHeader(bw *bitWriter, length int) {
+	bw.write(1, 0)
+	nibbles := uint(4)
+	for nibbles < 6 && length-1 >= 1<<(4*nibbles) {
+		nibbles++
+	}
+	bw.write(2, uint64(nibbles-4))
+	bw.write(4*nibbles, uint64(length-1))
+}
+
+// brotliCommand inserts insert literals starting at data[literals], then
+// copies copy bytes from dist bytes back. The last command of a
+// meta-block may have no copy.
+type brotliCommand struct {
+	literals, insert int
+	copy, dist       int
+}
+
+// findCommands splits data into commands, trying up to depth earlier
+// positions with the same four bytes at each position and taking the
+// longest match.
+func findCommands(data []byte, depth int) []brotliCommand {
+	var head [1 << brotliHashBits]int32
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(data))
+	hash := func(i int) uint32 {
+		v := uint32(data[i]) | uint32(data[i+1])<<8 | uint32(data[i+2])<<16 | uint32(data[i+3])<<24
+		return (v * 0x1e35a7bd) >> (32 - brotliHashBits)
+	}
+	insertHash := func(i int) {
+		h := hash(i)
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+
+	var cmds []brotliCommand
+	start := 0
+	for i := 0; i+brotliMinMatch <= len(data); {
+		bestLen, bestDist := 0, 0
+		for cand, tries := head[hash(i)], 0; cand >= 0 && tries < depth; cand, tries = prev[cand], tries+1 {
+			n := 0
+			for i+n < len(data) && data[int(cand)+n] == data[i+n] {
+				n++
+			}
+			if n > bestLen {
+				bestLen, bestDist = n, i-int(cand)
+			}
+		}
+		insertHash(i)
+		if bestLen < brotliMinMatch {
+			i++
+			continue
+		}
+		cmds = append(cmds, brotliCommand{literals: start, insert: i - start, copy: bestLen, dist: bestDist})
+		for j := i + 1; j < i+bestLen && j+brotliMinMatch <= len(data); j++ {
+			insertHash(j)
+		}
+		i += bestLen
+		start = i
+	}
+	if start < len(data) {
+		cmds = append(cmds, brotliCommand{literals: start, insert: len(data) - start})
+	}
+	return cmds
+}
+
+// lengthCode returns the code covering n in base and the extra bits that
+// follow it.
+func lengthCode(base *[24]uint32, n uint32) (code int, extra uint32) {
+	code = sort.Search(len(base), func(i int) bool { return base[i] > n }) - 1
+	return code, n - base[code]
+}
+
+// brotliCommandRows are the first insert&copy symbols, in units of 64,
+// for insert code rows 0-7, 8-15 and 16-23 by copy code columns of the
+// same sizes, among the rows followed by an explicit distance.
+var brotliCommandRows = [3][3]int{{2, 3, 6}, {4, 5, 8}, {7, 9, 10}}
+
+// commandCode combines insert and copy length codes into an insert&copy
+// symbol that is followed by an explicit distance.
+func commandCode(insert, copy int) int {
+	return brotliCommandRows[insert>>3][copy>>3]*64 + (insert&7)<<3 | copy&7
+}
+
+// distanceCode encodes a distance of at least 1 with no postfix and no
+// direct codes.
+func distanceCode(dist int) (code int, extraBits uint, extra uint32) {
+	d := uint32(dist) + 3
+	nbits := uint(0)
+	for d>>(nbits+1) != 0 {
+		nbits++
+	}
+	nbits-- // d has nbits+2 significant bits
+	prefix := (d >> nbits) & 1
+	return 16 + 2*int(nbits-1) + int(prefix), nbits, d - (2+prefix)<<nbits
+}
+
+// compressCommands writes the rest of a compressed meta-block: one block
+// type and one prefix code for each alphabet, then the commands.
+func compressCommands(bw *bitWriter, data []byte, cmds []brotliCommand) {
+	type encoded struct {
+		cmd                    int
+		insertExtra, copyExtra uint32
+		insertBits, copyBits   uint
+		dist                   int
+		distExtra              uint32
+		distBits               uint
+	}
+	litFreq := make([]uint32, brotliLiteralAlphabet)
+	cmdFreq := make([]uint32, brotliCommandAlphabet)
+	distFreq := make([]uint32, brotliDistanceAlphabet)
+	enc := make([]encoded, len(cmds))
+	for i, c := range cmds {
+		ic, ie := lengthCode(&brotliInsertBase, uint32(c.insert))
+		copyLen := c.copy
+		if copyLen == 0 {
+			// The meta-block ends with the literals; the copy is never read.
+			copyLen = 2
+		}
+		cc, ce := lengthCode(&brotliCopyBase, uint32(copyLen))
+		e := encoded{
+			cmd:         commandCode(ic, cc),
+			insertExtra: ie, insertBits: brotliInsertExtra[ic],
+			copyExtra: ce, copyBits: brotliCopyExtra[cc],
+			dist: -1,
+		}
+		if c.copy > 0 {
+			e.dist, e.distBits, e.distExtra = distanceCode(c.dist)
+			distFreq[e.dist]++
+		}
+		cmdFreq[e.cmd]++
+		for _, lit := range data[c.literals : c.literals+c.insert] {
+			litFreq[lit]++
+		}
+		enc[i] = e
+	}
+
+	bw.write(3, 0) // NBLTYPESL, NBLTYPESI, NBLTYPESD: one each
+	bw.write(2, 0) // NPOSTFIX
+	bw.write(4, 0) // NDIRECT
+	bw.write(2, 0) // literal context mode
+	bw.write(1, 0) // NTREESL
+	bw.write(1, 0) // NTREESD
+	lit := bw.prefixCode(litFreq, 8)
+	cmd := bw.prefixCode(cmdFreq, 10)
+	dist := bw.prefixCode(distFreq, 6)
+
+	for i, c := range cmds {
+		e := enc[i]
+		cmd.put(bw, e.cmd)
+		bw.write(e.insertBits, uint64(e.insertExtra))
+		bw.write(e.copyBits, uint64(e.copyExtra))
+		for _, b := range data[c.literals : c.literals+c.insert] {
+			lit.put(bw, int(b))
+		}
+		if e.dist >= 0 {
+			dist.put(bw, e.dist)
+			bw.write(e.distBits, uint64(e.distExtra))
+		}
+	}
+}
+
+// prefixCode is a canonical prefix code with its codes bit-reversed, ready
+// to be written least significant bit first.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint16
+}
+
+func (pc prefixCode) put(bw *bitWriter, sym int) {
+	bw.write(uint(pc.lengths[sym]), uint64(pc.codes[sym]))
+}
+
+// prefixCode builds a code for freq, writes its description and returns
+// it. An alphabet with at most one symbol in use gets a simple code whose
+// symbol takes no bits.
+func (bw *bitWriter) prefixCode(freq []uint32, alphabetBits uint) prefixCode {
+	var used []int
+	for sym, f := range freq {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+	if len(used) < 2 {
+		sym := 0
+		if len(used) == 1 {
+			sym = used[0]
+		}
+		bw.write(2, 1) // simple prefix code
+		bw.write(2, 0) // NSYM-1
+		bw.write(alphabetBits, uint64(sym))
+		return prefixCode{lengths: make([]uint8, len(freq)), codes: make([]uint16, len(freq))}
+	}
+	pc := prefixCode{lengths: huffmanLengths(freq, 15)}
+	pc.codes = canonicalCodes(pc.lengths)
+	bw.writeCodeLengths(pc.lengths)
+	return pc
+}
+
+// codeLengthOrder is the order code length code lengths are stored in.
+var codeLengthOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeCodeLengths writes a complex prefix code: the symbol code lengths,
+// up to the last non-zero one, coded with a code length code. Runs of
+// three or more zeros use repeat code 17; two 17s never follow each other,
+// so each run stands alone.
+func (bw *bitWriter) writeCodeLengths(lengths []uint8) {
+	last := len(lengths) - 1
+	for lengths[last] == 0 {
+		last--
+	}
+	type token struct{ sym, extra uint8 }
+	var tokens []token
+	after17 := false
+	for i := 0; i <= last; {
+		if lengths[i] != 0 {
+			tokens = append(tokens, token{sym: lengths[i]})
+			after17 = false
+			i++
+			continue
+		}
+		run := 0
+		for i+run <= last && lengths[i+run] == 0 {
+			run++
+		}
+		i += run
+		for run > 0 {
+			if run >= 3 && !after17 {
+				n := min(run, 10)
+				tokens = append(tokens, token{sym: 17, extra: uint8(n - 3)})
+				run -= n
+				after17 = true
+			} else {
+				tokens = append(tokens, token{sym: 0})
+				run--
+				after17 = false
+			}
+		}
+	}
+
+	clFreq := make([]uint32, 18)
+	for _, t := range tokens {
+		clFreq[t.sym]++
+	}
+	distinct := 0
+	for _, f := range clFreq {
+		if f > 0 {
+			distinct++
+		}
+	}
+	var clLengths []uint8
+	var clCodes []uint16
+	if distinct == 1 {
+		// A code length code with one symbol is stored as a single
+		// non-zero length, and its symbol then takes no bits.
+		clLengths = make([]uint8, 18)
+		for sym, f := range clFreq {
+			if f > 0 {
+				clLengths[sym] = 1
+			}
+		}
+		clCodes = make([]uint16, 18)
+	} else {
+		clLengths = huffmanLengths(clFreq, 5)
+		clCodes = canonicalCodes(clLengths)
+	}
+
+	stored := len(codeLengthOrder)
+	if distinct > 1 {
+		for clLengths[codeLengthOrder[stored-1]] == 0 {
+			stored--
+		}
+	}
+	// The code length code lengths use a fixed code, given here already
+	// bit-reversed.
+	fixedCodes := [6]uint64{0, 7, 3, 2, 1, 15}
+	fixedBits := [6]uint{2, 4, 3, 2, 2, 4}
+	bw.write(2, 0) // HSKIP: no lengths skipped
+	for _, sym := range codeLengthOrder[:stored] {
+		l := clLengths[sym]
+		bw.write(fixedBits[l], fixedCodes[l])
+	}
+
+	for _, t := range tokens {
+		if distinct > 1 {
+			bw.write(uint(clLengths[t.sym]), uint64(clCodes[t.sym]))
+		}
+		if t.sym == 17 {
+			bw.write(3, uint64(t.extra))
+		}
+	}
+}
+
+// huffmanLengths returns prefix code lengths of at most limit bits for the
+// symbols with a non-zero frequency. When the optimal code is too deep,
+// small frequencies are raised until it fits.
+func huffmanLengths(freq []uint32, limit int) []uint8 {
+	var used []int
+	for sym, f := range freq {
+		if f > 0 {
+			used = append(used, sym)
+		}
+	}
+	lengths := make([]uint8, len(freq))
+	type node struct {
+		weight uint64
+		parent int
+	}
+	for floor := uint64(1); ; floor *= 2 {
+		nodes := make([]node, len(used), 2*len(used)-1)
+		order := append([]int(nil), used...)
+		for i, sym := range order {
+			nodes[i] = node{weight: max(uint64(freq[sym]), floor), parent: -1}
+		}
+		sort.Sort(byWeight{order, func(i int) uint64 { return nodes[i].weight }, func(i, j int) {
+			nodes[i], nodes[j] = nodes[j], nodes[i]
+		}})
+
+		// Two queues: the sorted leaves, and the merged nodes, which are
+		// created in order of weight.
+		leaf, merged := 0, len(used)
+		next := func() int {
+			if leaf < len(used) && (merged == len(nodes) || nodes[leaf].weight <= nodes[merged].weight) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for len(nodes) < cap(nodes) {
+			a, b := next(), next()
+			nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, parent: -1})
+			nodes[a].parent, nodes[b].parent = len(nodes)-1, len(nodes)-1
+		}
+
+		depth := make([]int, len(nodes))
+		deepest := 0
+		for i := len(nodes) - 2; i >= 0; i-- {
+			depth[i] = depth[nodes[i].parent] + 1
+			deepest = max(deepest, depth[i])
+		}
+		if deepest <= limit {
+			for i, sym := range order {
+				lengths[sym] = uint8(depth[i])
+			}
+			return lengths
+		}
+	}
+}
+
+// byWeight sorts symbols and their nodes together by node weight.
+type byWeight struct {
+	syms   []int
+	weight func(i int) uint64
+	swap   func(i, j int)
+}
+
+func (s byWeight) Len() int           { return len(s.syms) }
+func (s byWeight) Less(i, j int) bool { return s.weight(i) < s.weight(j) }
+func (s byWeight) Swap(i, j int) {
+	s.syms[i], s.syms[j] = s.syms[j], s.syms[i]
+	s.swap(i, j)
+}
+
+// canonicalCodes assigns canonical codes to lengths, shortest first and
+// then by symbol, and reverses their bits for writing.
+func canonicalCodes(lengths []uint8) []uint16 {
+	var count [16]int
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+		}
+	}
+	var next [16]int
+	code := 0
+	for bits := 1; bits < 16; bits++ {
+		code = (code + count[bits-1]) << 1
+		next[bits] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint16
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | uint16(c>>i&1)
+		}
+		codes[sym] = rev
+	}
+	return codes
+}
+
+// bitWriter packs values least significant bit first.
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (bw *bitWriter) write(nbits uint, v uint64) {
+	bw.acc |= v << bw.n
+	bw.n += nbits
+	for bw.n >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.n -= 8
+	}
+}
+
+// align pads with zero bits to the next byte boundary.
+func (bw *bitWriter) align() {
+	if bw.n > 0 {
+		bw.write(8-bw.n, 0)
+	}
+}
+
+// appendBits writes everything in other after what bw holds.
+func (bw *bitWriter) appendBits(other *bitWriter) {
+	for _, b := range other.buf {
+		bw.write(8, uint64(b))
+	}
+	bw.write(other.n, other.acc)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+// brotliDecode decodes the subset of RFC 7932 that brotliWriter produces:
+// one block type per category, no context modelling, no postfix or
+// direct distance codes and no static dictionary. It follows the RFC
+// rather than the writer, so the two cannot share a mistake.
+func brotliDecode(data []byte) ([]byte, error) {
+	br := &brotliBits{data: data}
+	if br.read(1) == 1 {
+		if n := br.read(3); n == 0 {
+			if m := br.read(3); m == 1 {
+				return nil, errors.New("invalid window size")
+			}
+		}
+	}
+	var out []byte
+	for {
+		last := br.read(1) == 1
+		if last && br.read(1) == 1 {
+			break
+		}
+		nibbles := br.read(2)
+		if nibbles == 3 {
+			if br.read(1) != 0 {
+				return nil, errors.New("reserved bit set")
+			}
+			skipBytes := br.read(2)
+			skip := 0
+			if skipBytes > 0 {
+				skip = br.read(8*skipBytes) + 1
+			}
+			br.align()
+			br.pos += 8 * skip
+			if last {
+				break
+			}
+			continue
+		}
+		mlen := br.read(4*(nibbles+4)) + 1
+		if !last && br.read(1) == 1 {
+			br.align()
+			start := br.pos / 8
+			if start+mlen > len(data) {
+				return nil, errors.New("uncompressed meta-block overruns the input")
+			}
+			out = append(out, data[start:start+mlen]...)
+			br.pos += 8 * mlen
+			continue
+		}
+		var err error
+		if out, err = decodeMetaBlock(br, out, mlen); err != nil {
+			return nil, err
+		}
+		if last {
+			break
+		}
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	if br.align(); br.pos/8 != len(data) {
+		return nil, fmt.Errorf("%d bytes after the last meta-block", len(data)-br.pos/8)
+	}
+	return out, nil
+}
+
+func decodeMetaBlock(br *brotliBits, out []byte, mlen int) ([]byte, error) {
+	for category := 0; category < 3; category++ {
+		if br.read(1) != 0 {
+			return nil, errors.New("more than one block type")
+		}
+	}
+	if br.read(2) != 0 || br.read(4) != 0 {
+		return nil, errors.New("postfix or direct distance codes")
+	}
+	br.read(2) // context mode, which one tree makes irrelevant
+	if br.read(1) != 0 || br.read(1) != 0 {
+		return nil, errors.New("more than one prefix code per category")
+	}
+	lit, err := readPrefixCode(br, 256)
+	if err != nil {
+		return nil, fmt.Errorf("literal code: %w", err)
+	}
+	cmd, err := readPrefixCode(br, 704)
+	if err != nil {
+		return nil, fmt.Errorf("command code: %w", err)
+	}
+	dist, err := readPrefixCode(br, 64)
+	if err != nil {
+		return nil, fmt.Errorf("distance code: %w", err)
+	}
+
+	insertCell := [11]int{0, 0, 0, 0, 8, 8, 0, 16, 8, 16, 16}
+	copyCell := [11]int{0, 8, 0, 8, 0, 8, 16, 0, 16, 8, 16}
+	lastDist := 4
+	for end := len(out) + mlen; len(out) < end; {
+		sym := cmd.decode(br)
+		cell := sym >> 6
+		if cell > 10 {
+			return nil, fmt.Errorf("invalid insert&copy symbol %d", sym)
+		}
+		ic := insertCell[cell] + sym>>3&7
+		cc := copyCell[cell] + sym&7
+		insert := int(brotliInsertBase[ic]) + br.read(int(brotliInsertExtra[ic]))
+		copyLen := int(brotliCopyBase[cc]) + br.read(int(brotliCopyExtra[cc]))
+		for range insert {
+			out = append(out, byte(lit.decode(br)))
+		}
+		if br.err != nil {
+			return nil, br.err
+		}
+		if len(out) >= end {
+			break
+		}
+		d := lastDist
+		if cell >= 2 {
+			code := dist.decode(br)
+			if code < 16 {
+				return nil, fmt.Errorf("distance code %d refers to earlier distances", code)
+			}
+			nbits := 1 + (code-16)>>1
+			d = (2+(code-16)&1)<<nbits - 4 + br.read(nbits) + 1
+			lastDist = d
+		}
+		if d > len(out) {
+			return nil, fmt.Errorf("distance %d reaches before the start", d)
+		}
+		for range copyLen {
+			out = append(out, out[len(out)-d])
+		}
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return out, nil
+}
+
+// readPrefixCode reads a simple code with one symbol or a complex code
+// for an alphabet of size symbols.
+func readPrefixCode(br *brotliBits, size int) (*brotliCode, error) {
+	hskip := br.read(2)
+	if hskip == 1 {
+		if br.read(2) != 0 {
+			return nil, errors.New("simple code with several symbols")
+		}
+		bits := 0
+		for 1<<bits < size {
+			bits++
+		}
+		sym := br.read(bits)
+		if sym >= size {
+			return nil, fmt.Errorf("simple code symbol %d out of range", sym)
+		}
+		return &brotliCode{single: true, symbol: sym}, br.err
+	}
+
+	order := [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	clLengths := make([]int, 18)
+	space, nonZero := 32, 0
+	for _, sym := range order[hskip:] {
+		l := readCodeLengthLength(br)
+		clLengths[sym] = l
+		if l > 0 {
+			space -= 32 >> l
+			nonZero++
+			if space <= 0 {
+				break
+			}
+		}
+	}
+	if nonZero != 1 && space != 0 {
+		return nil, errors.New("incomplete code length code")
+	}
+	clCode := newBrotliCode(clLengths)
+
+	lengths := make([]int, size)
+	prev, repeat, repeatSym := 8, 0, -1
+	space = 32768
+	for i := 0; i < size && space > 0; {
+		sym := clCode.decode(br)
+		if sym < 16 {
+			lengths[i] = sym
+			i++
+			repeat, repeatSym = 0, -1
+			if sym > 0 {
+				prev = sym
+				space -= 32768 >> sym
+			}
+			continue
+		}
+		extraBits, value := 2, prev
+		if sym == 17 {
+			extraBits, value = 3, 0
+		}
+		if repeatSym != sym {
+			repeat, repeatSym = 0, sym
+		}
+		old := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+		repeat += br.read(extraBits) + 3
+		for range repeat - old {
+			if i == size {
+				return nil, errors.New("repeat past the end of the alphabet")
+			}
+			lengths[i] = value
+			i++
+			if value > 0 {
+				space -= 32768 >> value
+			}
+		}
+	}
+	if space != 0 {
+		return nil, errors.New("incomplete prefix code")
+	}
+	return newBrotliCode(lengths), br.err
+}
+
+// readCodeLengthLength reads one code length code length with the fixed
+// variable-length code of RFC 7932 section 3.5.
+func readCodeLengthLength(br *brotliBits) int {
+	switch v := br.read(2); v {
+	case 0:
+		return 0
+	case 1:
+		return 4
+	case 2:
+		return 3
+	}
+	if br.read(1) == 0 {
+		return 2
+	}
+	if br.read(1) == 0 {
+		return 1
+	}
+	return 5
+}
+
+// brotliCode decodes a canonical prefix code, one bit at a time.
+type brotliCode struct {
+	single  bool
+	symbol  int
+	symbols map[[2]int]int // {length, code} to symbol
+}
+
+func newBrotliCode(lengths []int) *brotliCode {
+	c := &brotliCode{symbols: map[[2]int]int{}}
+	used := 0
+	code := 0
+	for l := 1; l <= 15; l++ {
+		for sym, sl := range lengths {
+			if sl == l {
+				c.symbols[[2]int{l, code}] = sym
+				c.symbol = sym
+				code++
+				used++
+			}
+		}
+		code <<= 1
+	}
+	c.single = used == 1
+	return c
+}
+
+func (c *brotliCode) decode(br *brotliBits) int {
+	if c.single {
+		return c.symbol
+	}
+	code := 0
+	for l := 1; l <= 15; l++ {
+		code = code<<1 | br.read(1)
+		if sym, ok := c.symbols[[2]int{l, code}]; ok {
+			return sym
+		}
+	}
+	br.fail(errors.New("invalid prefix code"))
+	return 0
+}
+
+// brotliBits reads bits least significant first, remembering the first
+// read past the end.
+type brotliBits struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *brotliBits) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if b.pos/8 >= len(b.data) {
+			b.fail(errors.New("unexpected end of stream"))
+			return 0
+		}
+		v |= int(b.data[b.pos/8]>>(b.pos%8)&1) << i
+		b.pos++
+	}
+	return v
+}
+
+func (b *brotliBits) align() {
+	b.pos = (b.pos + 7) &^ 7
+}
+
+func (b *brotliBits) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func TestBrotliRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 100<<10)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	lot := `{"name":"Lot %d","address":"Tverskaya %d","distance_m":%d,"free":%d},`
+	var lots strings.Builder
+	lots.WriteString(`{"parking":[`)
+	for i := 0; lots.Len() < 200<<10; i++ {
+		fmt.Fprintf(&lots, lot, i, i%40, i*17%3000, i%23)
+	}
+	inputs := map[string][]byte{
+		"empty":       nil,
+		"one byte":    []byte("x"),
+		"short":       []byte(`{"ok":true}`),
+		"repetitive":  bytes.Repeat([]byte("abcabcabd"), 1000),
+		"json":        []byte(lots.String()),
+		"random":      random,
+		"one literal": bytes.Repeat([]byte{'z'}, 70000),
+	}
+	for name, input := range inputs {
+		for _, level := range []int{1, 5, 9} {
+			var buf bytes.Buffer
+			w := newBrotliWriter(&buf, level)
+			// Write in pieces, flushing once, as the middleware does.
+			half := len(input) / 2
+			w.Write(input[:half])
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			w.Write(input[half:])
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := brotliDecode(buf.Bytes())
+			if err != nil {
+				t.Errorf("%s at level %d: decode: %v", name, level, err)
+				continue
+			}
+			if !bytes.Equal(got, input) {
+				t.Errorf("%s at level %d: round trip changed the data", name, level)
+			}
+			if name == "json" && buf.Len() > len(input)/4 {
+				t.Errorf("json at level %d: %d bytes compressed to %d", level, len(input), buf.Len())
+			}
+		}
+	}
+}
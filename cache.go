@@ -0,0 +1,245 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxCachedBodyBytes = 1 << 20
+
+type cacheEntry struct {
+	bufferedResponse
+	expires time.Time
+	// vary, when set, marks an entry that stands for a URI whose response
+	// varies on these headers; the response itself is stored under the
+	// variant key.
+	vary []string
+}
+
+// cacheBackend stores cache entries for up to ttl. Implementations are
+// safe for concurrent use; a backend that cannot be reached reports a
+// miss rather than failing.
+type cacheBackend interface {
+	Get(key string) (*cacheEntry, bool)
+	Set(key string, e *cacheEntry, ttl time.Duration)
+	Delete(key string)
+	// Flush removes every entry and returns how many there were.
+	Flush() int
+}
+
+// responseCache is a TTL cache of upstream responses keyed by request URI.
+// Expired entries are kept for a further staleTTL so they can stand in
+// when the upstream fails.
+//
+// Responses are stored per variant: the request's values for the headers
+// named in the response's Vary header extend the key, and responses with
+// Vary: * are not stored.
+type responseCache struct {
+	store cacheBackend
+
+	mu       sync.Mutex
+	ttl      time.Duration
+	staleTTL time.Duration
+}
+
+func newResponseCache(ttl, staleTTL time.Duration, store cacheBackend) *responseCache {
+	return &responseCache{store: store, ttl: ttl, staleTTL: staleTTL}
+}
+
+// SetTTL changes the lifetimes of entries stored from now on.
+func (c *responseCache) SetTTL(ttl, staleTTL time.Duration) {
+	c.mu.Lock()
+	c.ttl, c.staleTTL = ttl, staleTTL
+	c.mu.Unlock()
+}
+
+func (c *responseCache) ttls() (ttl, staleTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ttl, c.staleTTL
+}
+
+// varyNames returns the canonical header names in a response's Vary
+// header, sorted, and whether it is Vary: *. Accept-Encoding is left out:
+// the gateway negotiates encoding with the upstream itself.
+func varyNames(h http.Header) (names []string, any bool) {
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch name {
+			case "*":
+				return nil, true
+			case "", "Accept-Encoding":
+			default:
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, false
+}
+
+// variantKey extends base with the request's values for names.
+func variantKey(base string, names []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(base)
+	for _, name := range names {
+		b.WriteString("\nvary " + name + "=" + strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+// lookup finds the entry for base matching the request headers h and the
+// key it is stored under.
+func (c *responseCache) lookup(base string, h http.Header) (*cacheEntry, string, bool) {
+	e, ok := c.store.Get(base)
+	if !ok || e.vary == nil {
+		return e, base, ok
+	}
+	key := variantKey(base, e.vary, h)
+	e, ok = c.store.Get(key)
+	return e, key, ok && e.vary == nil
+}
+
+// Get returns a fresh entry for key and the request headers h.
+func (c *responseCache) Get(key string, h http.Header) (*cacheEntry, bool) {
+	e, _, ok := c.lookup(key, h)
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e, true
+}
+
+// GetStale returns an entry for key and the request headers h that may
+// have expired, as long as it is still within the stale window.
+func (c *responseCache) GetStale(key string, h http.Header) (*cacheEntry, bool) {
+	e, stored, ok := c.lookup(key, h)
+	if !ok {
+		return nil, false
+	}
+	if _, staleTTL := c.ttls(); time.Now().After(e.expires.Add(staleTTL)) {
+		c.store.Delete(stored)
+		return nil, false
+	}
+	return e, true
+}
+
+// Set stores br as the response to key with the request headers h.
+func (c *responseCache) Set(key string, h http.Header, br *bufferedResponse) {
+	names, varyAll := varyNames(br.header)
+	if varyAll {
+		return
+	}
+	ttl, staleTTL := c.ttls()
+	expires := time.Now().Add(ttl)
+	e := &cacheEntry{
+		bufferedResponse: bufferedResponse{
+			status: br.status,
+			header: br.header.Clone(),
+			body:   br.body,
+		},
+		expires: expires,
+	}
+	if len(names) > 0 {
+		c.store.Set(key, &cacheEntry{expires: expires, vary: names}, ttl+staleTTL)
+		key = variantKey(key, names, h)
+	}
+	c.store.Set(key, e, ttl+staleTTL)
+}
+
+// Flush removes every entry and returns how many there were.
+func (c *responseCache) Flush() int {
+	return c.store.Flush()
+}
+
+// memoryCache is the in-process cacheBackend. With maxEntries set, the
+// least recently used entry is evicted once the cache is full.
+type memoryCache struct {
+	maxEntries int
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List // front is most recently used
+	lastSweep time.Time
+}
+
+type memoryItem struct {
+	key      string
+	entry    *cacheEntry
+	deadline time.Time
+}
+
+func newMemoryCache(maxEntries int) *memoryCache {
+	return &memoryCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (m *memoryCache) Get(key string) (*cacheEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	item := el.Value.(*memoryItem)
+	if time.Now().After(item.deadline) {
+		m.remove(el)
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	return item.entry, true
+}
+
+func (m *memoryCache) Set(key string, e *cacheEntry, ttl time.Duration) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Sub(m.lastSweep) > ttl {
+		for _, el := range m.entries {
+			if now.After(el.Value.(*memoryItem).deadline) {
+				m.remove(el)
+			}
+		}
+		m.lastSweep = now
+	}
+	item := &memoryItem{key: key, entry: e, deadline: now.Add(ttl)}
+	if el, ok := m.entries[key]; ok {
+		el.Value = item
+		m.lru.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.lru.PushFront(item)
+	if m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		m.remove(m.lru.Back())
+	}
+}
+
+func (m *memoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+}
+
+// remove drops el. The caller holds m.mu.
+func (m *memoryCache) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryItem).key)
+}
+
+func (m *memoryCache) Flush() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := m.lru.Len()
+	m.entries = make(map[string]*list.Element)
+	m.lru.Init()
+	return n
+}
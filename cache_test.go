@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	_ cacheBackend = (*memoryCache)(nil)
+	_ cacheBackend = (*redisCache)(nil)
+)
+
+// get requests path from h and returns the recorded response.
+func get(h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCacheServesStaleWhenUpstreamFails(t *testing.T) {
+	var failing atomic.Bool
+	var version atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{"error":"down"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"version":%d}`, version.Add(1))
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	p.Cache = newResponseCache(50*time.Millisecond, time.Minute, newMemoryCache(0))
+	h := p.Handler()
+
+	steps := []struct {
+		name      string
+		fail      bool
+		wait      time.Duration
+		wantCache string
+		wantBody  string
+	}{
+		{name: "cold miss", wantCache: "MISS", wantBody: `{"version":1}`},
+		{name: "fresh hit", wantCache: "HIT", wantBody: `{"version":1}`},
+		{name: "stale on error", fail: true, wait: 60 * time.Millisecond, wantCache: "STALE", wantBody: `{"version":1}`},
+		{name: "successful refresh", wantCache: "MISS", wantBody: `{"version":2}`},
+	}
+	for _, step := range steps {
+		failing.Store(step.fail)
+		time.Sleep(step.wait)
+		rec := get(h, "/api/occupancy?id=1", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", step.name, rec.Code)
+		}
+		if got := rec.Header().Get("X-Cache"); got != step.wantCache {
+			t.Errorf("%s: X-Cache = %q, want %q", step.name, got, step.wantCache)
+		}
+		if got := rec.Body.String(); got != step.wantBody {
+			t.Errorf("%s: body = %q, want %q", step.name, got, step.wantBody)
+		}
+		if warning := rec.Header().Get("Warning"); (step.wantCache == "STALE") != (warning != "") {
+			t.Errorf("%s: Warning = %q", step.name, warning)
+		}
+	}
+}
+
+func TestCacheColdMissOnDownUpstream(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	p := newTestProxy(down.URL)
+	p.Cache = newResponseCache(time.Minute, time.Minute, newMemoryCache(0))
+
+	if rec := get(p.Handler(), "/api/occupancy?id=1", nil); rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+}
+
+func TestCacheAnswersNotModifiedFromStoredETag(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, `{"free":3}`)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	p.Cache = newResponseCache(time.Minute, 0, newMemoryCache(0))
+	h := p.Handler()
+
+	get(h, "/api/occupancy?id=1", nil)
+	rec := get(h, "/api/occupancy?id=1", http.Header{"If-None-Match": {`W/"v1"`}})
+
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 has a %d byte body", rec.Body.Len())
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hit %d times, want 1", got)
+	}
+}
+
+func TestCacheKeysOnVaryHeaders(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Vary", r.URL.Query().Get("vary"))
+		fmt.Fprintf(w, `{"response":%d}`, n)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	p.Cache = newResponseCache(time.Minute, 0, newMemoryCache(0))
+	h := p.Handler()
+
+	ru := http.Header{"Accept-Language": {"ru"}}
+	en := http.Header{"Accept-Language": {"en"}}
+	for _, req := range []struct {
+		header    http.Header
+		wantCache string
+		wantBody  string
+	}{
+		{header: ru, wantCache: "MISS", wantBody: `{"response":1}`},
+		{header: en, wantCache: "MISS", wantBody: `{"response":2}`},
+		{header: ru, wantCache: "HIT", wantBody: `{"response":1}`},
+		{header: en, wantCache: "HIT", wantBody: `{"response":2}`},
+	} {
+		rec := get(h, "/api/occupancy?vary=Accept-Language", req.header)
+		if got := rec.Header().Get("X-Cache"); got != req.wantCache {
+			t.Errorf("%s: X-Cache = %q, want %q", req.header, got, req.wantCache)
+		}
+		if got := rec.Body.String(); got != req.wantBody {
+			t.Errorf("%s: body = %q, want %q", req.header, got, req.wantBody)
+		}
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("upstream hit %d times, want one per variant", got)
+	}
+
+	hits.Store(0)
+	get(h, "/api/occupancy?vary=*", ru)
+	get(h, "/api/occupancy?vary=*", ru)
+	if got := hits.Load(); got != 2 {
+		t.Errorf("Vary: * was cached: upstream hit %d times, want 2", got)
+	}
+}
+
+func TestOpenCircuitServesStaleCache(t *testing.T) {
+	for _, cached := range []bool{true, false} {
+		var failing atomic.Bool
+		var hits atomic.Int32
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.Header().Set("Content-Type", "application/json")
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			io.WriteString(w, `{"free":3}`)
+		}))
+		p := newTestProxy(upstream.URL)
+		p.Coalesce = &flightGroup{}
+		p.Breaker = newCircuitBreaker("epo", 1, time.Minute)
+		if cached {
+			p.Cache = newResponseCache(20*time.Millisecond, time.Minute, newMemoryCache(0))
+		}
+		h := p.Handler()
+
+		get(h, "/api/parking/occupancy?id=1", nil)
+		time.Sleep(30 * time.Millisecond)
+		failing.Store(true)
+		get(h, "/api/parking/occupancy?id=1", nil) // opens the circuit
+		hits.Store(0)
+		rec := get(h, "/api/parking/occupancy?id=1", nil)
+		upstream.Close()
+
+		if hits.Load() != 0 {
+			t.Errorf("cached=%v: open circuit let %d requests through", cached, hits.Load())
+		}
+		if !cached {
+			if rec.Code != http.StatusServiceUnavailable || errorCode(rec.Body.Bytes()) != errCodeCircuitOpen {
+				t.Errorf("no cache: got %d %s, want 503 %s", rec.Code, rec.Body, errCodeCircuitOpen)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || rec.Body.String() != `{"free":3}` {
+			t.Errorf("cache: got %d %q, want the stale entry", rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("X-Cache"); got != "STALE-CIRCUIT" {
+			t.Errorf("cache: X-Cache = %q, want STALE-CIRCUIT", got)
+		}
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	entry := func(body string) *cacheEntry {
+		return &cacheEntry{bufferedResponse: bufferedResponse{status: http.StatusOK, body: []byte(body)}}
+	}
+	body := func(c cacheBackend, key string) string {
+		e, ok := c.Get(key)
+		if !ok {
+			return "<miss>"
+		}
+		return string(e.body)
+	}
+
+	t.Run("ttl", func(t *testing.T) {
+		c := newMemoryCache(0)
+		c.Set("short", entry("a"), 20*time.Millisecond)
+		c.Set("long", entry("b"), time.Minute)
+		if got := body(c, "short"); got != "a" {
+			t.Fatalf("fresh entry = %s, want a", got)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if got := body(c, "short"); got != "<miss>" {
+			t.Errorf("expired entry = %s, want a miss", got)
+		}
+		if got := body(c, "long"); got != "b" {
+			t.Errorf("unexpired entry = %s, want b", got)
+		}
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		c := newMemoryCache(2)
+		c.Set("a", entry("a"), time.Minute)
+		c.Set("b", entry("b"), time.Minute)
+		body(c, "a") // a is now the most recently used
+		c.Set("c", entry("c"), time.Minute)
+		for key, want := range map[string]string{"a": "a", "b": "<miss>", "c": "c"} {
+			if got := body(c, key); got != want {
+				t.Errorf("%s = %s, want %s", key, got, want)
+			}
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		c := newMemoryCache(2)
+		c.Set("a", entry("old"), time.Minute)
+		c.Set("a", entry("new"), time.Minute)
+		if got := body(c, "a"); got != "new" {
+			t.Errorf("a = %s, want new", got)
+		}
+		if n := c.Flush(); n != 1 {
+			t.Errorf("Flush removed %d entries, want 1", n)
+		}
+	})
+
+	t.Run("delete and flush", func(t *testing.T) {
+		c := newMemoryCache(0)
+		for _, key := range []string{"a", "b", "c"} {
+			c.Set(key, entry(key), time.Minute)
+		}
+		c.Delete("b")
+		c.Delete("missing")
+		if got := body(c, "b"); got != "<miss>" {
+			t.Errorf("deleted entry = %s, want a miss", got)
+		}
+		if n := c.Flush(); n != 2 {
+			t.Errorf("Flush removed %d entries, want 2", n)
+		}
+		if got := body(c, "a"); got != "<miss>" {
+			t.Errorf("entry after Flush = %s, want a miss", got)
+		}
+	})
+}
+
+func TestUnreachableRedisIsAMiss(t *testing.T) {
+	client, err := newRedisClient("redis://127.0.0.1:" + freePort(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"parking":[]}`)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	p.Cache = newResponseCache(time.Minute, time.Minute, newRedisCache(client, "test:"))
+	h := p.Handler()
+
+	for i := range 2 {
+		rec := get(h, "/api/nearest", nil)
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("request %d: status %d, X-Cache %q, want 200 and MISS",
+				i, rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withCanonicalHost permanently redirects requests for any other host to
+// host, keeping the scheme, path and query. Probe and metrics endpoints
+// are exempt because orchestrators call them by IP. An empty host
+// disables the redirect.
+func withCanonicalHost(host string, trustProxy bool, next http.Handler) http.Handler {
+	if host == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz", "/readyz", "/metrics":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.EqualFold(r.Host, host) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if v := r.Header.Get("X-Forwarded-Proto"); trustProxy && (v == "http" || v == "https") {
+			scheme = v
+		}
+		target := scheme + "://" + host + r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// combinedBudgetShare is the part of REQUEST_TIMEOUT each combined fetch
+// may use; the rest is left for assembling the response before the
+// request timeout answers 503 instead.
+const combinedBudgetShare = 0.9
+
+// combinedBudget is the deadline of each combined fetch under
+// requestTimeout.
+func combinedBudget(requestTimeout time.Duration) time.Duration {
+	return time.Duration(float64(requestTimeout) * combinedBudgetShare)
+}
+
+type combinedPart struct {
+	name  string
+	proxy *Proxy
+	data  json.RawMessage
+	err   error
+}
+
+// combinedHandler fetches nearest parking and occupancy concurrently and
+// returns them as one JSON object. Each fetch gets its own budget, so one
+// slow upstream cannot hold back the other. If only one upstream succeeds
+// the response is 206 with the failure described under "errors".
+func combinedHandler(nearest, occupancy *Proxy, budget time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			nearest.CORS.preflight(w, r, "GET, HEAD, OPTIONS")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "only GET and HEAD are supported")
+			return
+		}
+		if !nearest.validQuery(w, r) {
+			return
+		}
+		nearest.normalizeQuery(r)
+		if r.Method == http.MethodHead {
+			// The parts are always fetched with GET; the server drops the
+			// body of the combined response.
+			r = r.Clone(r.Context())
+			r.Method = http.MethodGet
+		}
+
+		// Each part is bounded by the budget and by its own route's timeout.
+		parts := []*combinedPart{
+			{name: "nearest", proxy: nearest},
+			{name: "occupancy", proxy: occupancy},
+		}
+		var wg sync.WaitGroup
+		for _, part := range parts {
+			wg.Add(1)
+			go func(part *combinedPart) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), budget)
+				defer cancel()
+				part.data, part.err = fetchJSON(ctx, part.proxy, r)
+				if part.err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) && r.Context().Err() == nil {
+					part.err = fmt.Errorf("upstream exceeded its %s budget", budget)
+				}
+			}(part)
+		}
+		wg.Wait()
+		if r.Context().Err() != nil {
+			return
+		}
+
+		body := map[string]any{}
+		errs := map[string]string{}
+		for _, part := range parts {
+			if part.err != nil {
+				errs[part.name] = part.err.Error()
+				continue
+			}
+			body[part.name] = part.data
+		}
+
+		status := http.StatusOK
+		switch len(errs) {
+		case 0:
+		case len(parts):
+			status = http.StatusBadGateway
+			body["errors"] = errs
+		default:
+			status = http.StatusPartialContent
+			body["errors"] = errs
+		}
+
+		nearest.CORS.apply(w.Header(), r)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+func fetchJSON(ctx context.Context, p *Proxy, r *http.Request) (json.RawMessage, error) {
+	br, err := p.fetchBuffered(ctx, withoutConditionals(r), p.upstreamURL(r))
+	if err != nil {
+		return nil, err
+	}
+	if br.status < 200 || br.status > 299 {
+		return nil, fmt.Errorf("upstream returned %d", br.status)
+	}
+	if !json.Valid(br.body) {
+		return nil, fmt.Errorf("upstream returned invalid JSON")
+	}
+	return br.body, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCombinedReturnsPartialResultWithinBudget(t *testing.T) {
+	fast := jsonUpstream(t, `{"parking":[]}`)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+		io.WriteString(w, `{}`)
+	}))
+	defer slow.Close()
+
+	const budget = 100 * time.Millisecond
+	h := combinedHandler(newTestProxy(fast.URL), newTestProxy(slow.URL), budget)
+	start := time.Now()
+	rec := get(h, "/api/parking/combined?lat=55.75&lng=37.61", nil)
+	elapsed := time.Since(start)
+
+	if elapsed > budget+500*time.Millisecond {
+		t.Errorf("combined took %s with a %s budget", elapsed, budget)
+	}
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rec.Code)
+	}
+	var body struct {
+		Nearest   json.RawMessage   `json:"nearest"`
+		Occupancy json.RawMessage   `json:"occupancy"`
+		Errors    map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if string(body.Nearest) != `{"parking":[]}` {
+		t.Errorf("nearest = %s, want the fast upstream's body", body.Nearest)
+	}
+	if body.Occupancy != nil || body.Errors["occupancy"] == "" {
+		t.Errorf("occupancy = %s, errors = %v; want occupancy marked failed", body.Occupancy, body.Errors)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const compressMinBytes = 1024
+
+// compressor encodes one response body.
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// encoders build a compressor for each supported content coding.
+var encoders = map[string]func(w io.Writer, level int) (compressor, error){
+	"gzip": func(w io.Writer, level int) (compressor, error) { return gzip.NewWriterLevel(w, level) },
+	"br":   func(w io.Writer, level int) (compressor, error) { return newBrotliWriter(w, level), nil },
+}
+
+// compressionOffers are the codings offered for each COMPRESSION_ALGO,
+// most preferred first. Clients without Brotli still get gzip.
+var compressionOffers = map[string][]string{
+	"gzip": {"gzip"},
+	"br":   {"br", "gzip"},
+}
+
+// withCompression compresses JSON and text responses at level with the
+// coding in offered that the client accepts most. Bodies smaller than
+// compressMinBytes, and responses to clients that accept none of offered,
+// are sent as is.
+func withCompression(offered []string, level int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		coding := ""
+		if r.Method != http.MethodHead {
+			coding = negotiateEncoding(r.Header.Get("Accept-Encoding"), offered)
+		}
+		if coding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, coding: coding, level: level}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the coding in offered that the Accept-Encoding
+// value accept gives the highest q-value, the earlier one on a tie, or ""
+// when it accepts none of them. "*" stands for the codings it does not
+// name, and a q-value that does not parse counts as 0.
+func negotiateEncoding(accept string, offered []string) string {
+	named := map[string]float64{}
+	wildcard := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(param, "=")
+			if ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+				v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || v < 0 || v > 1 {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else {
+			named[coding] = q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range offered {
+		q, ok := named[coding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mediaType == eventStreamType {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || strings.HasPrefix(mediaType, "text/")
+}
+
+// compressResponseWriter holds back the status line until it has seen
+// enough of the body to decide whether compression is worthwhile.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	coding  string
+	level   int
+	status  int
+	buf     []byte
+	decided bool
+	enc     compressor
+}
+
+func (c *compressResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *compressResponseWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.decided {
+		c.buf = append(c.buf, b...)
+		if len(c.buf) >= compressMinBytes {
+			if err := c.decide(); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if c.enc != nil {
+		return c.enc.Write(b)
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *compressResponseWriter) decide() error {
+	c.decided = true
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	h := c.Header()
+	eligible := h.Get("Content-Encoding") == "" && compressibleType(h.Get("Content-Type")) &&
+		c.status != http.StatusNoContent && c.status != http.StatusNotModified &&
+		c.status != http.StatusPartialContent
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && len(c.buf) >= compressMinBytes {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", c.coding)
+		c.ResponseWriter.WriteHeader(c.status)
+		enc, err := encoders[c.coding](c.ResponseWriter, c.level)
+		if err != nil {
+			return err
+		}
+		c.enc = enc
+		_, err = c.enc.Write(c.buf)
+		c.buf = nil
+		return err
+	}
+	c.ResponseWriter.WriteHeader(c.status)
+	_, err := c.ResponseWriter.Write(c.buf)
+	c.buf = nil
+	return err
+}
+
+func (c *compressResponseWriter) Flush() {
+	if !c.decided {
+		c.decide()
+	}
+	if c.enc != nil {
+		c.enc.Flush()
+	}
+	http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+func (c *compressResponseWriter) Close() error {
+	if !c.decided {
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+	if c.enc != nil {
+		return c.enc.Close()
+	}
+	return nil
+}
+
+func (c *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
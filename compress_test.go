@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	both := []string{"br", "gzip"}
+	tests := []struct {
+		accept  string
+		offered []string
+		want    string
+	}{
+		{accept: "", offered: both, want: ""},
+		{accept: "gzip", offered: both, want: "gzip"},
+		{accept: "gzip, br", offered: both, want: "br"},
+		{accept: "br;q=0.5, gzip;q=0.8", offered: both, want: "gzip"},
+		{accept: "br;q=0.25, gzip;q=0.125", offered: both, want: "br"},
+		{accept: "br;q=0, gzip", offered: both, want: "gzip"},
+		{accept: "GZIP;Q=1", offered: both, want: "gzip"},
+		{accept: "*", offered: both, want: "br"},
+		{accept: "br;q=0, *;q=0.1", offered: both, want: "gzip"},
+		{accept: "gzip;q=abc", offered: both, want: ""},
+		{accept: "gzip;q=2", offered: both, want: ""},
+		{accept: "identity, deflate", offered: both, want: ""},
+		{accept: "br", offered: []string{"gzip"}, want: ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept, tt.offered); got != tt.want {
+			t.Errorf("negotiateEncoding(%q, %q) = %q, want %q", tt.accept, tt.offered, got, tt.want)
+		}
+	}
+}
+
+// compressed returns the response of a compressing handler at level that
+// writes body as JSON.
+func compressed(offered []string, level int, accept, body string) *http.Response {
+	h := withCompression(offered, level, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	return get(h, "/api/parking/nearest", http.Header{"Accept-Encoding": {accept}}).Result()
+}
+
+func jsonBody(n int) string {
+	var b strings.Builder
+	b.WriteString("[")
+	for i := 0; b.Len() < n; i++ {
+		b.WriteString(`{"name":"Lot ` + strings.Repeat("x", i%7) + `","free":` + strconv.Itoa(i%10) + `},`)
+	}
+	return b.String() + "{}]"
+}
+
+func TestCompressionGzipLevel(t *testing.T) {
+	body := jsonBody(64 << 10)
+	sizes := map[int]int{}
+	for _, level := range []int{1, 9} {
+		resp := compressed([]string{"gzip"}, level, "gzip", body)
+		if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+			t.Fatalf("level %d: Content-Encoding = %q, want gzip", level, enc)
+		}
+		raw, _ := io.ReadAll(resp.Body)
+		zr, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := io.ReadAll(zr)
+		if err != nil || string(plain) != body {
+			t.Fatalf("level %d: gzip body does not decode to the original (%v)", level, err)
+		}
+		sizes[level] = len(raw)
+	}
+	if sizes[9] >= sizes[1] {
+		t.Errorf("level 9 gave %d bytes, level 1 %d; want level 9 smaller", sizes[9], sizes[1])
+	}
+}
+
+func TestCompressionBrotli(t *testing.T) {
+	body := jsonBody(8 << 10)
+	resp := compressed(compressionOffers["br"], 5, "gzip, deflate, br", body)
+	if enc := resp.Header.Get("Content-Encoding"); enc != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", enc)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	plain, err := brotliDecode(raw)
+	if err != nil || string(plain) != body {
+		t.Fatalf("br body does not decode to the original (%v)", err)
+	}
+
+	// Clients without Brotli fall back to gzip.
+	if enc := compressed(compressionOffers["br"], 5, "gzip", body).Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("gzip-only client: Content-Encoding = %q, want gzip", enc)
+	}
+}
+
+func TestCompressionPassesThrough(t *testing.T) {
+	body := jsonBody(8 << 10)
+	for _, tt := range []struct{ name, accept, body string }{
+		{name: "accepts nothing", accept: "", body: body},
+		{name: "accepts another coding", accept: "deflate, br", body: body},
+		{name: "small body", accept: "gzip", body: `{"free":3}`},
+	} {
+		resp := compressed([]string{"gzip"}, 5, tt.accept, tt.body)
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", tt.name, enc)
+		}
+		if got, _ := io.ReadAll(resp.Body); string(got) != tt.body {
+			t.Errorf("%s: body changed", tt.name)
+		}
+	}
+}
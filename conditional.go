@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// withoutConditionals returns r without conditional request headers, for
+// fetches whose full body is needed.
+func withoutConditionals(r *http.Request) *http.Request {
+	if r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "" {
+		return r
+	}
+	r2 := r.Clone(r.Context())
+	for _, h := range conditionalHeaders {
+		r2.Header.Del(h)
+	}
+	return r2
+}
+
+// etagMatches reports whether an If-None-Match value matches etag using
+// the weak comparison RFC 9110 prescribes for GET.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified sends a 304 keeping only the headers RFC 9110 allows.
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding"} {
+		h.Del(key)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
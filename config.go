@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// concurrencyWait is how long a request may queue for an upstream slot.
+const concurrencyWait = 2 * time.Second
+
+// Config is the resolved gateway configuration.
+type Config struct {
+	FrontendPort  string
+	BindAddress   string
+	ParserBaseURL string
+	EPOBaseURL    string
+	StaticDir     string
+
+	ParserNearestPath    string
+	EPOOccupancyPath     string
+	UpstreamTimeout      time.Duration
+	UpstreamMaxRetries   int
+	ShutdownTimeout      time.Duration
+	RequestTimeout       time.Duration
+	ReadTimeout          time.Duration
+	ReadHeaderTimeout    time.Duration
+	WriteTimeout         time.Duration
+	IdleTimeout          time.Duration
+	LogFormat            string
+	LogLevel             string
+	LogSampleRate        float64
+	CompressionAlgo      string
+	CompressionLevel     int
+	OccupancyCacheTTL    time.Duration
+	StaleIfError         time.Duration
+	AllowedOrigins       string
+	TrustProxyHeaders    bool
+	RateLimitRPS         float64
+	RateLimitBurst       int
+	SPAFallback          bool
+	ServeStatic          bool
+	StaticPrefix         string
+	BreakerThreshold     int
+	BreakerCooldown      time.Duration
+	RequestIDHeader      string
+	TLSCertFile          string
+	TLSKeyFile           string
+	Routes               []proxyRoute
+	MaxResponseBytes     int64
+	ForwardAuth          bool
+	ParserMaxConcurrency int
+	EPOMaxConcurrency    int
+	MaxIdleConns         int
+	MaxIdleConnsPerHost  int
+	IdleConnTimeout      time.Duration
+	AccessLogFile        string
+	AccessLogMaxMB       int
+	WaitForUpstreams     bool
+	SelfTest             bool
+	Warmup               bool
+	StartupTimeout       time.Duration
+	HealthInterval       time.Duration
+	// CoordPrecision is the number of decimal places coordinates are
+	// rounded to; negative disables rounding.
+	CoordPrecision       int
+	OTLPEndpoint         string
+	OTELServiceName      string
+	ParserDefaultQuery   url.Values
+	ValidateJSON         bool
+	SlowRequestThreshold time.Duration
+	ParserHostOverride   string
+	ParserCanaryURL      string
+	ParserCanaryWeight   int
+	EPOHostOverride      string
+	CanonicalHost        string
+	ParserBasicAuth      string
+	EPOBasicAuth         string
+	NearestCacheSize     int
+	NearestCacheTTL      time.Duration
+	CacheBackend         string
+	RedisURL             string
+	AdminToken           string
+	EnablePprof          bool
+	MaxRequestBytes      int64
+	MaintenanceMode      bool
+	EnforceJSON          bool
+	ParserTimeout        time.Duration
+	EPOTimeout           time.Duration
+	FollowRedirects      bool
+	NearestAllowedParams map[string]bool
+	ForwardHeaders       []string
+	RetryJitter          bool
+	RetryBudgetRatio     float64
+	ServeStaticStrict    bool
+	LowercaseAPIPaths    bool
+	MockMode             bool
+	MockDir              string
+}
+
+// DefaultConfig returns the configuration used when nothing is set.
+func DefaultConfig() *Config {
+	return &Config{
+		FrontendPort:  "12300",
+		ParserBaseURL: "http://127.0.0.1:8001",
+		EPOBaseURL:    "http://127.0.0.1:5000",
+		StaticDir:     "./public",
+		MockDir:       "./mocks",
+
+		ParserNearestPath:    "/parking/nearest",
+		EPOOccupancyPath:     "/api/parking/occupancy",
+		UpstreamTimeout:      10 * time.Second,
+		UpstreamMaxRetries:   2,
+		RetryJitter:          true,
+		RetryBudgetRatio:     0.1,
+		ShutdownTimeout:      15 * time.Second,
+		RequestTimeout:       30 * time.Second,
+		ReadTimeout:          30 * time.Second,
+		ReadHeaderTimeout:    5 * time.Second,
+		WriteTimeout:         60 * time.Second,
+		IdleTimeout:          120 * time.Second,
+		LogFormat:            "text",
+		LogLevel:             "info",
+		LogSampleRate:        1,
+		CompressionAlgo:      "gzip",
+		CompressionLevel:     5,
+		OccupancyCacheTTL:    30 * time.Second,
+		StaleIfError:         5 * time.Minute,
+		RateLimitRPS:         10,
+		RateLimitBurst:       20,
+		ServeStatic:          true,
+		StaticPrefix:         "/",
+		BreakerThreshold:     5,
+		BreakerCooldown:      30 * time.Second,
+		RequestIDHeader:      "X-Request-Id",
+		MaxResponseBytes:     10 << 20,
+		ParserMaxConcurrency: 50,
+		EPOMaxConcurrency:    50,
+		MaxIdleConns:         256,
+		MaxIdleConnsPerHost:  64,
+		IdleConnTimeout:      90 * time.Second,
+		AccessLogMaxMB:       100,
+		StartupTimeout:       30 * time.Second,
+		HealthInterval:       15 * time.Second,
+		CoordPrecision:       -1,
+		OTELServiceName:      "parking-gateway",
+		SlowRequestThreshold: 2 * time.Second,
+		MaxRequestBytes:      1 << 20,
+		NearestCacheSize:     256,
+		NearestCacheTTL:      60 * time.Second,
+		CacheBackend:         "memory",
+	}
+}
+
+// LoadConfig resolves the configuration from environment variables, then
+// CONFIG_FILE (default ./config.yaml), then built-in defaults.
+func LoadConfig() (*Config, error) {
+	path := configFilePath()
+	file, err := loadConfigFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	cfg := DefaultConfig()
+	l := &configLoader{file: file}
+	l.string(&cfg.FrontendPort, "FRONTEND_PORT")
+	l.string(&cfg.BindAddress, "BIND_ADDRESS")
+	l.string(&cfg.ParserBaseURL, "PARSER_BASE_URL")
+	l.string(&cfg.EPOBaseURL, "EPO_BASE_URL")
+	l.string(&cfg.ParserNearestPath, "PARSER_NEAREST_PATH")
+	l.string(&cfg.EPOOccupancyPath, "EPO_OCCUPANCY_PATH")
+	l.string(&cfg.StaticDir, "STATIC_DIR")
+	l.duration(&cfg.UpstreamTimeout, "UPSTREAM_TIMEOUT")
+	l.int(&cfg.UpstreamMaxRetries, "UPSTREAM_MAX_RETRIES")
+	l.bool(&cfg.RetryJitter, "RETRY_JITTER")
+	l.float(&cfg.RetryBudgetRatio, "RETRY_BUDGET_RATIO")
+	l.duration(&cfg.ParserTimeout, "PARSER_TIMEOUT")
+	l.duration(&cfg.EPOTimeout, "EPO_TIMEOUT")
+	l.duration(&cfg.ShutdownTimeout, "SHUTDOWN_TIMEOUT")
+	l.duration(&cfg.RequestTimeout, "REQUEST_TIMEOUT")
+	l.duration(&cfg.ReadTimeout, "READ_TIMEOUT")
+	l.duration(&cfg.ReadHeaderTimeout, "READ_HEADER_TIMEOUT")
+	l.duration(&cfg.WriteTimeout, "WRITE_TIMEOUT")
+	l.duration(&cfg.IdleTimeout, "IDLE_TIMEOUT")
+	l.string(&cfg.LogFormat, "LOG_FORMAT")
+	l.string(&cfg.LogLevel, "LOG_LEVEL")
+	l.fraction(&cfg.LogSampleRate, "LOG_SAMPLE_RATE")
+	l.string(&cfg.CompressionAlgo, "COMPRESSION_ALGO")
+	l.int(&cfg.CompressionLevel, "COMPRESSION_LEVEL")
+	l.duration(&cfg.OccupancyCacheTTL, "OCCUPANCY_CACHE_TTL")
+	l.duration(&cfg.StaleIfError, "STALE_IF_ERROR")
+	l.int(&cfg.NearestCacheSize, "NEAREST_CACHE_SIZE")
+	l.duration(&cfg.NearestCacheTTL, "NEAREST_CACHE_TTL")
+	l.string(&cfg.CacheBackend, "CACHE_BACKEND")
+	l.string(&cfg.RedisURL, "REDIS_URL")
+	l.string(&cfg.AllowedOrigins, "ALLOWED_ORIGINS")
+	l.bool(&cfg.TrustProxyHeaders, "TRUST_PROXY_HEADERS")
+	l.float(&cfg.RateLimitRPS, "RATE_LIMIT_RPS")
+	l.int(&cfg.RateLimitBurst, "RATE_LIMIT_BURST")
+	l.bool(&cfg.SPAFallback, "SPA_FALLBACK")
+	l.bool(&cfg.ServeStatic, "SERVE_STATIC")
+	l.bool(&cfg.ServeStaticStrict, "SERVE_STATIC_STRICT")
+	l.string(&cfg.StaticPrefix, "STATIC_PREFIX")
+	l.bool(&cfg.LowercaseAPIPaths, "LOWERCASE_API_PATHS")
+	l.int(&cfg.BreakerThreshold, "CIRCUIT_BREAKER_THRESHOLD")
+	l.duration(&cfg.BreakerCooldown, "CIRCUIT_BREAKER_COOLDOWN")
+	l.string(&cfg.RequestIDHeader, "REQUEST_ID_HEADER")
+	l.string(&cfg.TLSCertFile, "TLS_CERT_FILE")
+	l.string(&cfg.TLSKeyFile, "TLS_KEY_FILE")
+	l.int64(&cfg.MaxResponseBytes, "MAX_RESPONSE_BYTES")
+	l.int64(&cfg.MaxRequestBytes, "MAX_REQUEST_BYTES")
+	l.bool(&cfg.ForwardAuth, "FORWARD_AUTH")
+	l.bool(&cfg.FollowRedirects, "FOLLOW_REDIRECTS")
+	l.int(&cfg.ParserMaxConcurrency, "PARSER_MAX_CONCURRENCY")
+	l.int(&cfg.EPOMaxConcurrency, "EPO_MAX_CONCURRENCY")
+	l.int(&cfg.MaxIdleConns, "MAX_IDLE_CONNS")
+	l.int(&cfg.MaxIdleConnsPerHost, "MAX_IDLE_CONNS_PER_HOST")
+	l.duration(&cfg.IdleConnTimeout, "IDLE_CONN_TIMEOUT")
+	l.string(&cfg.AccessLogFile, "ACCESS_LOG_FILE")
+	l.int(&cfg.AccessLogMaxMB, "ACCESS_LOG_MAX_MB")
+	l.bool(&cfg.WaitForUpstreams, "WAIT_FOR_UPSTREAMS")
+	l.bool(&cfg.SelfTest, "SELF_TEST")
+	l.bool(&cfg.Warmup, "WARMUP")
+	l.duration(&cfg.StartupTimeout, "STARTUP_TIMEOUT")
+	l.duration(&cfg.HealthInterval, "HEALTH_INTERVAL")
+	l.int(&cfg.CoordPrecision, "COORD_PRECISION")
+	l.bool(&cfg.ValidateJSON, "VALIDATE_JSON")
+	l.bool(&cfg.EnforceJSON, "ENFORCE_JSON")
+	l.duration(&cfg.SlowRequestThreshold, "SLOW_REQUEST_THRESHOLD")
+	l.string(&cfg.AdminToken, "ADMIN_TOKEN")
+	l.bool(&cfg.EnablePprof, "ENABLE_PPROF")
+	l.bool(&cfg.MaintenanceMode, "MAINTENANCE_MODE")
+	l.bool(&cfg.MockMode, "MOCK_MODE")
+	l.string(&cfg.MockDir, "MOCK_DIR")
+	l.string(&cfg.ParserHostOverride, "PARSER_HOST_OVERRIDE")
+	l.string(&cfg.ParserCanaryURL, "PARSER_CANARY_URL")
+	l.int(&cfg.ParserCanaryWeight, "PARSER_CANARY_WEIGHT")
+	l.string(&cfg.EPOHostOverride, "EPO_HOST_OVERRIDE")
+	l.string(&cfg.CanonicalHost, "CANONICAL_HOST")
+	l.string(&cfg.ParserBasicAuth, "PARSER_BASIC_AUTH")
+	l.string(&cfg.EPOBasicAuth, "EPO_BASIC_AUTH")
+	l.string(&cfg.OTLPEndpoint, "OTEL_EXPORTER_OTLP_ENDPOINT")
+	l.string(&cfg.OTELServiceName, "OTEL_SERVICE_NAME")
+
+	if raw := l.lookup("PARSER_DEFAULT_QUERY"); raw != "" {
+		q, err := url.ParseQuery(raw)
+		if err != nil {
+			l.invalid("PARSER_DEFAULT_QUERY", raw, "a query string such as source=frontend&version=2")
+		}
+		cfg.ParserDefaultQuery = q
+	}
+
+	if raw := l.lookup("NEAREST_ALLOWED_PARAMS"); raw != "" {
+		cfg.NearestAllowedParams = map[string]bool{}
+		for _, name := range strings.Split(raw, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cfg.NearestAllowedParams[name] = true
+			}
+		}
+	}
+
+	// Hop-by-hop headers describe the client connection and are never
+	// forwarded, even when listed.
+	for _, name := range strings.Split(l.lookup("FORWARD_HEADERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" && !isHopHeader(name) {
+			cfg.ForwardHeaders = append(cfg.ForwardHeaders, http.CanonicalHeaderKey(name))
+		}
+	}
+
+	cfg.StaticPrefix = normalizePrefix(cfg.StaticPrefix)
+	cfg.RequestIDHeader = http.CanonicalHeaderKey(cfg.RequestIDHeader)
+
+	routes, err := parseProxyRoutes(l.lookup("PROXY_ROUTES"), map[string]string{
+		"PARSER": cfg.parserBaseURLs()[0],
+		"EPO":    cfg.EPOBaseURL,
+	}, cfg.reservedRoutes())
+	if err != nil {
+		l.problems = append(l.problems, "PROXY_ROUTES: "+err.Error())
+	}
+	cfg.Routes = routes
+
+	problems := append(l.problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return cfg, nil
+}
+
+// reservedRoutes are the patterns the server registers itself, which
+// PROXY_ROUTES may not reuse.
+func (c *Config) reservedRoutes() []string {
+	reserved := append(append([]string(nil), builtinRoutes...), gatewayRoutes...)
+	if c.ServeStatic {
+		reserved = append(reserved, c.StaticPrefix)
+	}
+	return reserved
+}
+
+// validate describes every setting that cannot work.
+func (c *Config) validate() []string {
+	var problems []string
+	if port, err := strconv.Atoi(c.FrontendPort); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("FRONTEND_PORT=%q is not a valid port", c.FrontendPort))
+	} else if _, err := net.ResolveTCPAddr("tcp", c.listenAddr()); err != nil {
+		problems = append(problems, fmt.Sprintf("BIND_ADDRESS=%q: %v", c.BindAddress, err))
+	}
+	for _, raw := range c.parserBaseURLs() {
+		if !isAbsoluteURL(raw) {
+			problems = append(problems, fmt.Sprintf("PARSER_BASE_URL entry %q is not an absolute URL", raw))
+		}
+	}
+	for key, p := range map[string]string{"PARSER_NEAREST_PATH": c.ParserNearestPath, "EPO_OCCUPANCY_PATH": c.EPOOccupancyPath} {
+		if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#") {
+			problems = append(problems, fmt.Sprintf("%s=%q must be a path starting with /", key, p))
+		}
+	}
+	if c.ParserCanaryURL != "" && !isAbsoluteURL(c.ParserCanaryURL) {
+		problems = append(problems, fmt.Sprintf("PARSER_CANARY_URL=%q is not an absolute URL", c.ParserCanaryURL))
+	}
+	if c.ParserCanaryWeight > 100 {
+		problems = append(problems, fmt.Sprintf("PARSER_CANARY_WEIGHT=%d must be between 0 and 100", c.ParserCanaryWeight))
+	} else if c.ParserCanaryWeight > 0 && c.ParserCanaryURL == "" {
+		problems = append(problems, "PARSER_CANARY_WEIGHT requires PARSER_CANARY_URL")
+	}
+	if !isAbsoluteURL(c.EPOBaseURL) {
+		problems = append(problems, fmt.Sprintf("EPO_BASE_URL=%q is not an absolute URL", c.EPOBaseURL))
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		problems = append(problems, fmt.Sprintf("LOG_FORMAT=%q: expected json or text", c.LogFormat))
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL=%q: expected debug, info, warn or error", c.LogLevel))
+	}
+	switch c.CompressionAlgo {
+	case "gzip", "br", "none":
+	default:
+		problems = append(problems, fmt.Sprintf("COMPRESSION_ALGO=%q: expected gzip, br or none", c.CompressionAlgo))
+	}
+	if c.CompressionLevel < 1 || c.CompressionLevel > 9 {
+		problems = append(problems, fmt.Sprintf("COMPRESSION_LEVEL=%d: expected 1 to 9", c.CompressionLevel))
+	}
+	if c.RateLimitBurst < 1 {
+		problems = append(problems, fmt.Sprintf("RATE_LIMIT_BURST=%d must be at least 1", c.RateLimitBurst))
+	}
+	if c.ParserMaxConcurrency < 1 || c.EPOMaxConcurrency < 1 {
+		problems = append(problems, "PARSER_MAX_CONCURRENCY and EPO_MAX_CONCURRENCY must be at least 1")
+	}
+	switch c.CacheBackend {
+	case "memory":
+	case "redis":
+		if _, err := newRedisClient(c.RedisURL); err != nil {
+			problems = append(problems, "REDIS_URL: "+err.Error())
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("CACHE_BACKEND=%q: expected memory or redis", c.CacheBackend))
+	}
+	if c.EnablePprof && c.AdminToken == "" {
+		problems = append(problems, "ENABLE_PPROF requires ADMIN_TOKEN")
+	}
+	if c.MaxIdleConnsPerHost < 1 || c.MaxIdleConns < c.MaxIdleConnsPerHost {
+		problems = append(problems, fmt.Sprintf("MAX_IDLE_CONNS_PER_HOST=%d must be between 1 and MAX_IDLE_CONNS=%d", c.MaxIdleConnsPerHost, c.MaxIdleConns))
+	}
+	if strings.HasPrefix(c.StaticPrefix, "/api/") {
+		problems = append(problems, fmt.Sprintf("STATIC_PREFIX=%q must not overlap the /api/ routes", c.StaticPrefix))
+	}
+	for key, host := range map[string]string{"PARSER_HOST_OVERRIDE": c.ParserHostOverride, "EPO_HOST_OVERRIDE": c.EPOHostOverride, "CANONICAL_HOST": c.CanonicalHost} {
+		if host != "" && !isValidHost(host) {
+			problems = append(problems, fmt.Sprintf("%s=%q is not a valid host[:port]", key, host))
+		}
+	}
+	for key, auth := range map[string]string{"PARSER_BASIC_AUTH": c.ParserBasicAuth, "EPO_BASIC_AUTH": c.EPOBasicAuth} {
+		// The value is a secret, so it is not repeated in the message.
+		if user, _, ok := strings.Cut(auth, ":"); auth != "" && (!ok || user == "") {
+			problems = append(problems, key+": expected user:password")
+		}
+	}
+	if c.OTLPEndpoint != "" && !isAbsoluteURL(c.OTLPEndpoint) {
+		problems = append(problems, fmt.Sprintf("OTEL_EXPORTER_OTLP_ENDPOINT=%q is not an absolute URL", c.OTLPEndpoint))
+	}
+	if c.CoordPrecision > 15 {
+		problems = append(problems, fmt.Sprintf("COORD_PRECISION=%d: expected at most 15 decimal places", c.CoordPrecision))
+	}
+	if c.RequestTimeout >= c.WriteTimeout {
+		problems = append(problems, fmt.Sprintf("REQUEST_TIMEOUT=%s must be less than WRITE_TIMEOUT=%s", c.RequestTimeout, c.WriteTimeout))
+	}
+	if c.ReadHeaderTimeout > c.ReadTimeout {
+		problems = append(problems, fmt.Sprintf("READ_HEADER_TIMEOUT=%s must not exceed READ_TIMEOUT=%s", c.ReadHeaderTimeout, c.ReadTimeout))
+	}
+	// A write deadline shorter than an upstream call would cut the
+	// connection before the gateway could answer 504.
+	for key, d := range map[string]time.Duration{"UPSTREAM_TIMEOUT": c.UpstreamTimeout, "PARSER_TIMEOUT": c.ParserTimeout, "EPO_TIMEOUT": c.EPOTimeout} {
+		if d >= c.WriteTimeout {
+			problems = append(problems, fmt.Sprintf("WRITE_TIMEOUT=%s must exceed %s=%s", c.WriteTimeout, key, d))
+		}
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problems = append(problems, "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	return problems
+}
+
+// listenAddr is the address the server binds to; an empty BIND_ADDRESS
+// means all interfaces.
+func (c *Config) listenAddr() string {
+	return net.JoinHostPort(c.BindAddress, c.FrontendPort)
+}
+
+// secretField matches configuration field names whose values must never
+// be shown.
+var secretField = regexp.MustCompile(`(?i)token|secret|key|password|basicauth`)
+
+// effective returns the resolved configuration keyed by field name, with
+// secret values redacted and credentials stripped from URLs.
+func (c *Config) effective() map[string]any {
+	out := map[string]any{}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		field := v.Field(i).Interface()
+		switch f := field.(type) {
+		case time.Duration:
+			field = f.String()
+		case string:
+			if u, err := url.Parse(f); err == nil && u.User != nil {
+				field = u.Redacted()
+			}
+		case []proxyRoute:
+			routes := make([]string, 0, len(f))
+			for _, r := range f {
+				route := r.pattern + "=" + r.target
+				if len(r.methods) > 0 {
+					route += " " + strings.Join(r.methods, ",")
+				}
+				if r.strip != "" {
+					route += " strip=" + r.strip
+				}
+				routes = append(routes, route)
+			}
+			field = routes
+		}
+		if secretField.MatchString(name) && !v.Field(i).IsZero() {
+			field = "[redacted]"
+		}
+		out[name] = field
+	}
+	return out
+}
+
+// parserBaseURLs splits the comma-separated PARSER_BASE_URL. The result is
+// never empty.
+func (c *Config) parserBaseURLs() []string {
+	var urls []string
+	for _, u := range strings.Split(c.ParserBaseURL, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		urls = append(urls, "")
+	}
+	return urls
+}
+
+// upstreamBaseURLs names every upstream base URL for health probes.
+func (c *Config) upstreamBaseURLs() map[string]string {
+	upstreams := map[string]string{"epo": c.EPOBaseURL}
+	if c.ParserCanaryURL != "" {
+		upstreams["parser-canary"] = c.ParserCanaryURL
+	}
+	parsers := c.parserBaseURLs()
+	if len(parsers) == 1 {
+		upstreams["parser"] = parsers[0]
+		return upstreams
+	}
+	for i, u := range parsers {
+		upstreams[fmt.Sprintf("parser-%d", i+1)] = u
+	}
+	return upstreams
+}
+
+func isAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
+
+// isValidHost reports whether h is a bare host or host:port.
+func isValidHost(h string) bool {
+	u, err := url.Parse("//" + h)
+	if err != nil || u.Host != h || u.User != nil || u.Hostname() == "" {
+		return false
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return false
+		}
+	}
+	return true
+}
+
+func configFilePath() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	return "./config.yaml"
+}
+
+// shadowedFileKeys returns those of keys that are set both in the
+// environment and in the config file, where the file's value is ignored.
+func shadowedFileKeys(keys []string) []string {
+	file, err := loadConfigFile(configFilePath())
+	if err != nil {
+		return nil
+	}
+	var shadowed []string
+	for _, key := range keys {
+		if _, ok := file[strings.ToLower(key)]; ok && os.Getenv(key) != "" {
+			shadowed = append(shadowed, key)
+		}
+	}
+	return shadowed
+}
+
+// configLoader overrides Config fields with values from the environment or
+// the config file, collecting parse errors instead of stopping at the
+// first one. Config file keys are the lower-cased variable names.
+type configLoader struct {
+	file     map[string]string
+	problems []string
+}
+
+func (l *configLoader) lookup(key string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return l.file[strings.ToLower(key)]
+}
+
+func (l *configLoader) invalid(key, v, expected string) {
+	l.problems = append(l.problems, fmt.Sprintf("%s=%q: expected %s", key, v, expected))
+}
+
+func (l *configLoader) string(dst *string, key string) {
+	if v := l.lookup(key); v != "" {
+		*dst = v
+	}
+}
+
+func (l *configLoader) duration(dst *time.Duration, key string) {
+	v := l.lookup(key)
+	if v == "" {
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		l.invalid(key, v, "a positive Go duration such as 10s or 500ms")
+		return
+	}
+	*dst = d
+}
+
+func (l *configLoader) int(dst *int, key string) {
+	v := l.lookup(key)
+	if v == "" {
+		return
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		l.invalid(key, v, "a non-negative integer")
+		return
+	}
+	*dst = n
+}
+
+func (l *configLoader) int64(dst *int64, key string) {
+	v := l.lookup(key)
+	if v == "" {
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		l.invalid(key, v, "a non-negative integer")
+		return
+	}
+	*dst = n
+}
+
+func (l *configLoader) bool(dst *bool, key string) {
+	v := l.lookup(key)
+	if v == "" {
+		return
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.invalid(key, v, "true or false")
+		return
+	}
+	*dst = b
+}
+
+func (l *configLoader) fraction(dst *float64, key string) {
+	v := l.lookup(key)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(f >= 0 && f <= 1) {
+		l.invalid(key, v, "a number from 0 to 1")
+		return
+	}
+	*dst = f
+}
+
+func (l *configLoader) float(dst *float64, key string) {
+	v := l.lookup(key)
+	if v == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(f > 0) {
+		l.invalid(key, v, "a positive number")
+		return
+	}
+	*dst = f
+}
+
+// loadConfigFile reads flat "key: value" YAML. A missing file yields no
+// values.
+func loadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := stripYAMLComment(scanner.Text())
+		if strings.TrimSpace(line) == "" || strings.TrimSpace(line) == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: nested values are not supported", lineNo)
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		values[strings.TrimSpace(key)] = unquoteYAML(strings.TrimSpace(value))
+	}
+	return values, scanner.Err()
+}
+
+func stripYAMLComment(line string) string {
+	if strings.HasPrefix(strings.TrimSpace(line), "#") {
+		return ""
+	}
+	if i := strings.Index(line, " #"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func unquoteYAML(v string) string {
+	if len(v) >= 2 && (v[0] == '"' && v[len(v)-1] == '"' || v[0] == '\'' && v[len(v)-1] == '\'') {
+		return v[1 : len(v)-1]
+	}
+	return v
+}
+
+// normalizePrefix makes p start and end with a slash.
+func normalizePrefix(p string) string {
+	p = "/" + strings.Trim(p, "/")
+	if p != "/" {
+		p += "/"
+	}
+	return p
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hasProblem reports whether validate flagged key.
+func hasProblem(c *Config, key string) bool {
+	for _, p := range c.validate() {
+		if strings.Contains(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateHostOverride(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"":                     true,
+		"parser.internal":      true,
+		"parser.internal:8080": true,
+		"parser internal":      false,
+		"http://parser":        false,
+	} {
+		c := DefaultConfig()
+		c.ParserHostOverride = host
+		if got := !hasProblem(c, "PARSER_HOST_OVERRIDE"); got != valid {
+			t.Errorf("PARSER_HOST_OVERRIDE=%q: valid = %v, want %v", host, got, valid)
+		}
+	}
+}
+
+// loadTestConfig loads the configuration from env alone, with no config
+// file.
+func loadTestConfig(t *testing.T, env map[string]string) *Config {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.yaml"))
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	return cfg
+}
+
+func TestValidateUpstreamPaths(t *testing.T) {
+	for path, valid := range map[string]bool{
+		"/parking/nearest": true,
+		"/":                true,
+		"parking/nearest":  false,
+		"":                 false,
+		"/nearest?x=1":     false,
+	} {
+		c := DefaultConfig()
+		c.ParserNearestPath = path
+		c.EPOOccupancyPath = path
+		for _, key := range []string{"PARSER_NEAREST_PATH", "EPO_OCCUPANCY_PATH"} {
+			if got := !hasProblem(c, key); got != valid {
+				t.Errorf("%s=%q: valid = %v, want %v", key, path, got, valid)
+			}
+		}
+	}
+}
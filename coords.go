@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// snapCoordinates returns a query normalizer that rounds lat, lng and
+// coordinates=lat,lng to the given number of decimal places, so nearby
+// points share one cache entry and upstream request. Every value of a
+// repeated parameter is rounded.
+func snapCoordinates(precision int) func(url.Values) {
+	return func(q url.Values) {
+		for _, key := range []string{"lat", "lng"} {
+			for i, v := range q[key] {
+				q[key][i] = roundCoordinate(v, precision)
+			}
+		}
+		for i, v := range q["coordinates"] {
+			if lat, lng, ok := strings.Cut(v, ","); ok {
+				q["coordinates"][i] = roundCoordinate(lat, precision) + "," + roundCoordinate(lng, precision)
+			}
+		}
+	}
+}
+
+// roundCoordinate formats raw rounded to precision places without
+// trailing zeros. Values that do not parse are returned unchanged.
+func roundCoordinate(raw string, precision int) string {
+	v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return raw
+	}
+	scale := math.Pow10(precision)
+	v = math.Round(v*scale) / scale
+	if v == 0 {
+		v = 0 // avoid "-0"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// corsPolicy decides the Access-Control-Allow-Origin value for API
+// responses. A nil policy or one without origins allows any origin.
+type corsPolicy struct {
+	origins map[string]bool
+}
+
+func newCORSPolicy(allowed string) *corsPolicy {
+	c := &corsPolicy{}
+	for _, origin := range strings.Split(allowed, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			if c.origins == nil {
+				c.origins = make(map[string]bool)
+			}
+			c.origins[origin] = true
+		}
+	}
+	return c
+}
+
+func (c *corsPolicy) apply(h http.Header, r *http.Request) {
+	h.Del("Access-Control-Allow-Origin")
+	if c == nil || c.origins == nil {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); c.origins[origin] {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+}
+
+// preflight answers a CORS preflight without contacting the upstream.
+func (c *corsPolicy) preflight(w http.ResponseWriter, r *http.Request, methods string) {
+	c.apply(w.Header(), r)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requested)
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+	}
+	w.Header().Set("Access-Control-Max-Age", "600")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Stable error codes the frontend can switch on.
+const (
+	errCodeMethodNotAllowed    = "method_not_allowed"
+	errCodeInvalidParams       = "invalid_params"
+	errCodeInvalidBody         = "invalid_body"
+	errCodeRequestTooLarge     = "request_too_large"
+	errCodeUpstreamUnavailable = "upstream_unavailable"
+	errCodeUpstreamTimeout     = "upstream_timeout"
+	errCodeRateLimited         = "rate_limited"
+	errCodeCircuitOpen         = "upstream_circuit_open"
+	errCodeUpstreamBusy        = "upstream_busy"
+	errCodeUpstreamError       = "upstream_error"
+	errCodeUpstreamInvalid     = "upstream_invalid_response"
+	errCodeUnauthorized        = "unauthorized"
+	errCodeMaintenance         = "maintenance"
+	errCodeRequestTimeout      = "request_timeout"
+	errCodeMockMissing         = "mock_missing"
+	errCodeInternal            = "internal_error"
+)
+
+type jsonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError writes {"error":{"code":...,"message":...}} with status.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]jsonError{
+		"error": {Code: code, Message: message},
+	})
+}
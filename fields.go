@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// fieldsTransformer trims nearest results to the parking fields listed in
+// fields=a,b,c. When the parameter names nothing, the body is relayed
+// unchanged.
+type fieldsTransformer struct{}
+
+func (fieldsTransformer) Param() string { return "fields" }
+
+func (fieldsTransformer) Transform(r *http.Request, body []byte, _ http.Header) ([]byte, error) {
+	keep := map[string]bool{}
+	for _, f := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			keep[f] = true
+		}
+	}
+	if len(keep) == 0 {
+		return body, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	// The parser wraps its result as {"total_found":n,"parking":{...}};
+	// only the parking objects are projected.
+	if wrapper, ok := doc.(map[string]any); ok {
+		if parking, ok := wrapper["parking"]; ok {
+			wrapper["parking"] = projectFields(parking, keep)
+			return json.Marshal(wrapper)
+		}
+	}
+	return json.Marshal(projectFields(doc, keep))
+}
+
+// projectFields keeps only the keep fields of v, or of each object in v
+// when it is an array. Unknown names are ignored.
+func projectFields(v any, keep map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key := range v {
+			if !keep[key] {
+				delete(v, key)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = projectFields(item, keep)
+		}
+	}
+	return v
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	readyProbeTimeout = 2 * time.Second
+	readyTotalTimeout = 3 * time.Second
+)
+
+var readyClient = &http.Client{Timeout: readyProbeTimeout}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports ready only when every upstream answers in time.
+func readyzHandler(upstreams map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTotalTimeout)
+		defer cancel()
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			failed = map[string]string{}
+		)
+		for name, baseURL := range upstreams {
+			wg.Add(1)
+			go func(name, baseURL string) {
+				defer wg.Done()
+				if err := probeUpstream(ctx, baseURL); err != nil {
+					mu.Lock()
+					failed[name] = err.Error()
+					mu.Unlock()
+				}
+			}(name, baseURL)
+		}
+		wg.Wait()
+
+		w.Header().Set("Content-Type", "application/json")
+		if len(failed) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]any{"status": "unavailable", "failed": failed})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"status": "ready"})
+	}
+}
+
+func probeUpstream(ctx context.Context, baseURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := readyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// waitForUpstreams polls every upstream until all respond or timeout
+// elapses, logging which ones are still unreachable.
+func waitForUpstreams(ctx context.Context, upstreams map[string]string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	pending := make(map[string]string, len(upstreams))
+	for name, baseURL := range upstreams {
+		pending[name] = baseURL
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		for name, baseURL := range pending {
+			if err := probeUpstream(ctx, baseURL); err != nil {
+				slog.Info("waiting for upstream", "upstream", name, "url", baseURL, "err", err)
+				continue
+			}
+			slog.Info("upstream is reachable", "upstream", name, "url", baseURL)
+			delete(pending, name)
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			names := make([]string, 0, len(pending))
+			for name := range pending {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("upstreams not reachable after %s: %s", timeout, strings.Join(names, ", "))
+		case <-ticker.C:
+		}
+	}
+}
+
+// warmUpstreams sends one HEAD request to each upstream through client so
+// the first real requests find names resolved and connections open in its
+// pool. Failures are only logged.
+func warmUpstreams(ctx context.Context, client *http.Client, upstreams map[string]string) {
+	var wg sync.WaitGroup
+	for name, baseURL := range upstreams {
+		wg.Add(1)
+		go func(name, baseURL string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+			defer cancel()
+			start := time.Now()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL, nil)
+			if err != nil {
+				slog.Warn("upstream warmup failed", "upstream", name, "err", err)
+				return
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				slog.Warn("upstream warmup failed", "upstream", name, "err", err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			slog.Info("upstream warmed up", "upstream", name, "duration_ms", time.Since(start).Milliseconds())
+		}(name, baseURL)
+	}
+	wg.Wait()
+}
+
+// upstreamHealth is the outcome of the latest probe of one upstream.
+type upstreamHealth struct {
+	Status    string     `json:"status"` // up, down or unknown
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	LatencyMS float64    `json:"latency_ms"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// healthProber probes every upstream in the background and serves the
+// latest results, so requests never wait on a probe.
+type healthProber struct {
+	upstreams map[string]string
+	interval  time.Duration
+
+	mu       sync.RWMutex
+	snapshot map[string]upstreamHealth
+}
+
+// newHealthProber starts probing upstreams every interval until ctx is
+// done.
+func newHealthProber(ctx context.Context, upstreams map[string]string, interval time.Duration) *healthProber {
+	h := &healthProber{
+		upstreams: upstreams,
+		interval:  interval,
+		snapshot:  make(map[string]upstreamHealth, len(upstreams)),
+	}
+	for name := range upstreams {
+		h.snapshot[name] = upstreamHealth{Status: "unknown"}
+	}
+	go h.run(ctx)
+	return h
+}
+
+func (h *healthProber) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *healthProber) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for name, baseURL := range h.upstreams {
+		wg.Add(1)
+		go func(name, baseURL string) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeUpstream(ctx, baseURL)
+			if ctx.Err() != nil {
+				return
+			}
+			checked := start.UTC()
+			result := upstreamHealth{
+				Status:    "up",
+				CheckedAt: &checked,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status, result.Error = "down", err.Error()
+			}
+			h.mu.Lock()
+			h.snapshot[name] = result
+			h.mu.Unlock()
+		}(name, baseURL)
+	}
+	wg.Wait()
+}
+
+// ServeHTTP reports the last probe of every upstream. The overall status
+// is ok when all are up and degraded otherwise.
+func (h *healthProber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	upstreams := make(map[string]upstreamHealth, len(h.snapshot))
+	status := "ok"
+	for name, result := range h.snapshot {
+		upstreams[name] = result
+		if result.Status != "up" {
+			status = "degraded"
+		}
+	}
+	h.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":           status,
+		"interval_seconds": h.interval.Seconds(),
+		"upstreams":        upstreams,
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// maintenanceRetryAfter is the Retry-After hint, in seconds, sent while the
+// API is in maintenance mode.
+const maintenanceRetryAfter = 120
+
+// withMaintenance answers every API request with 503 while enabled is set.
+// Static assets are still served so the frontend can show a maintenance
+// page.
+func withMaintenance(enabled *atomic.Bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enabled.Load() && strings.HasPrefix(r.URL.Path, "/api/") {
+			w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, errCodeMaintenance, "the service is down for maintenance")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceHandler reports maintenance mode on GET and switches it with
+// POST ?enabled=true|false.
+func maintenanceHandler(enabled *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, errCodeInvalidParams, "enabled must be true or false")
+				return
+			}
+			enabled.Store(on)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "only GET and POST are supported")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]bool{"maintenance": enabled.Load()})
+	}
+}
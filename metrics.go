@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type requestKey struct {
+	route  string
+	status int
+}
+
+// metrics is a minimal Prometheus-compatible registry for the proxy.
+type metrics struct {
+	inflight atomic.Int64
+
+	mu          sync.Mutex
+	requests    map[requestKey]uint64
+	durations   map[string]*histogram
+	cacheLookup map[cacheLookupKey]uint64
+	retryBudget *retryBudget
+}
+
+type cacheLookupKey struct {
+	route  string
+	result string
+}
+
+var proxyMetrics = newMetrics()
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:    make(map[requestKey]uint64),
+		durations:   make(map[string]*histogram),
+		cacheLookup: make(map[cacheLookupKey]uint64),
+	}
+}
+
+// register declares the routes metrics are recorded for, so each is
+// exported from the first scrape. Route names label every series and must
+// be unique and non-empty.
+func (m *metrics) register(routes []string) error {
+	seen := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		if route == "" {
+			return errors.New("route without a name")
+		}
+		if seen[route] {
+			return fmt.Errorf("route name %q is used by more than one route", route)
+		}
+		seen[route] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, route := range routes {
+		if _, ok := m.durations[route]; !ok {
+			m.durations[route] = &histogram{counts: make([]uint64, len(durationBuckets))}
+		}
+	}
+	return nil
+}
+
+// setRetryBudget exports the state of b.
+func (m *metrics) setRetryBudget(b *retryBudget) {
+	m.mu.Lock()
+	m.retryBudget = b
+	m.mu.Unlock()
+}
+
+// observeCache counts a cache lookup; result is hit, miss or stale.
+func (m *metrics) observeCache(route, result string) {
+	m.mu.Lock()
+	m.cacheLookup[cacheLookupKey{route, result}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeRequest(route string, status int) {
+	m.mu.Lock()
+	m.requests[requestKey{route, status}]++
+	m.mu.Unlock()
+}
+
+func (m *metrics) observeUpstream(route string, d time.Duration) {
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.durations[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(durationBuckets))}
+		m.durations[route] = h
+	}
+	for i, le := range durationBuckets {
+		if secs <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += secs
+	h.count++
+}
+
+// withInflight counts the requests being served in m.inflight.
+func withInflight(m *metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inflight.Add(1)
+		defer m.inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP proxy_requests_total Proxied requests by route and response status.")
+	fmt.Fprintln(w, "# TYPE proxy_requests_total counter")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "proxy_requests_total{route=%q,status=\"%d\"} %d\n", k.route, k.status, m.requests[k])
+	}
+
+	fmt.Fprintln(w, "# HELP proxy_upstream_duration_seconds Upstream call latency by route.")
+	fmt.Fprintln(w, "# TYPE proxy_upstream_duration_seconds histogram")
+	routes := make([]string, 0, len(m.durations))
+	for route := range m.durations {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.durations[route]
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "proxy_upstream_duration_seconds_bucket{route=%q,le=%q} %d\n", route, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "proxy_upstream_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(w, "proxy_upstream_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(w, "proxy_upstream_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP proxy_cache_lookups_total Response cache lookups by route and result.")
+	fmt.Fprintln(w, "# TYPE proxy_cache_lookups_total counter")
+	lookups := make([]cacheLookupKey, 0, len(m.cacheLookup))
+	for k := range m.cacheLookup {
+		lookups = append(lookups, k)
+	}
+	sort.Slice(lookups, func(i, j int) bool {
+		if lookups[i].route != lookups[j].route {
+			return lookups[i].route < lookups[j].route
+		}
+		return lookups[i].result < lookups[j].result
+	})
+	for _, k := range lookups {
+		fmt.Fprintf(w, "proxy_cache_lookups_total{route=%q,result=%q} %d\n", k.route, k.result, m.cacheLookup[k])
+	}
+
+	if m.retryBudget != nil {
+		tokens, allowed, denied := m.retryBudget.snapshot()
+		fmt.Fprintln(w, "# HELP proxy_retry_budget_tokens Retries the shared retry budget currently allows.")
+		fmt.Fprintln(w, "# TYPE proxy_retry_budget_tokens gauge")
+		fmt.Fprintf(w, "proxy_retry_budget_tokens %g\n", tokens)
+		fmt.Fprintln(w, "# HELP proxy_retries_total Upstream retries by whether the retry budget allowed them.")
+		fmt.Fprintln(w, "# TYPE proxy_retries_total counter")
+		fmt.Fprintf(w, "proxy_retries_total{result=\"allowed\"} %d\n", allowed)
+		fmt.Fprintf(w, "proxy_retries_total{result=\"denied\"} %d\n", denied)
+	}
+
+	fmt.Fprintln(w, "# HELP proxy_inflight_requests Requests currently being served.")
+	fmt.Fprintln(w, "# TYPE proxy_inflight_requests gauge")
+	fmt.Fprintf(w, "proxy_inflight_requests %d\n", m.inflight.Load())
+}
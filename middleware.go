@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in mw so that mw[0] is outermost and sees each request
+// first. Nil entries, for middleware that is switched off, are skipped.
+func Chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		if mw[i] != nil {
+			h = mw[i](h)
+		}
+	}
+	return h
+}
+
+// responseWriter records the status code and body size written by a handler.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += n
+	return n, err
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+type requestLogKey struct{}
+
+// requestLog carries per-request details that handlers fill in for the
+// access log line. A handler that timed out may still be writing to it.
+type requestLog struct {
+	mu       sync.Mutex
+	upstream string
+}
+
+func setUpstream(ctx context.Context, target string) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.mu.Lock()
+		rl.upstream = target
+		rl.mu.Unlock()
+	}
+}
+
+func (rl *requestLog) upstreamURL() string {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.upstream
+}
+
+// withLogging logs every request, or with sampleRate below 1 that
+// fraction of them; server errors and requests slower than slow are
+// always logged.
+func withLogging(logger *slog.Logger, sampleRate float64, slow time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rl := &requestLog{}
+		rw := &responseWriter{ResponseWriter: w}
+
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		if sampleRate < 1 && status < 500 && elapsed <= slow && mathrand.Float64() >= sampleRate {
+			return
+		}
+		logger.Info("request",
+			"request_id", requestIDFrom(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"upstream", rl.upstreamURL(),
+			"status", status,
+			"bytes", rw.bytes,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+		)
+	})
+}
+
+type requestIDKey struct{}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID reuses the incoming request ID from header or generates
+// one, echoes it on the response and stores it in the request context.
+func withRequestID(header string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(header, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// withRecovery turns a handler panic into a logged stack trace and a 500
+// response instead of a dropped connection.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.Error("panic serving request",
+				"request_id", requestIDFrom(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", v,
+				"stack", string(debug.Stack()),
+			)
+			if rw.status == 0 {
+				writeJSONError(rw, http.StatusInternalServerError, errCodeInternal, "internal server error")
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// withAPIPathNormalization routes /api/ paths with trailing slashes, and
+// with lowercase set also mixed-case ones, to their canonical handler.
+// Other paths are left alone: static file names are case-sensitive and
+// directories need their trailing slash.
+func withAPIPathNormalization(lowercase bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if len(p) < len("/api/") || !strings.EqualFold(p[:len("/api/")], "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if lowercase {
+			p = strings.ToLower(p)
+		}
+		if trimmed := strings.TrimRight(p, "/"); trimmed != "/api" {
+			p = trimmed
+		}
+		if p != r.URL.Path {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = p
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
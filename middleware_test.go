@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoveryKeepsServerUp(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) {
+		panic("deliberate")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := httptest.NewServer(withRecovery(mux))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/boom")
+	if err != nil {
+		t.Fatalf("panicking request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+
+	resp, err = http.Get(srv.URL + "/ok")
+	if err != nil {
+		t.Fatalf("request after panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status after panic = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAPIPathNormalization(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/parking/nearest", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "nearest")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "static "+r.URL.Path)
+	})
+
+	tests := []struct {
+		lowercase bool
+		path      string
+		want      string
+	}{
+		{lowercase: false, path: "/api/parking/nearest/", want: "nearest"},
+		{lowercase: false, path: "/api/parking/nearest//", want: "nearest"},
+		{lowercase: true, path: "/API/Parking/Nearest", want: "nearest"},
+		{lowercase: true, path: "/api/parking/Nearest/", want: "nearest"},
+		{lowercase: false, path: "/api/parking/Nearest", want: "static /api/parking/Nearest"},
+		{lowercase: true, path: "/Assets/App.JS", want: "static /Assets/App.JS"},
+		{lowercase: true, path: "/docs/", want: "static /docs/"},
+	}
+	for _, tt := range tests {
+		rec := get(withAPIPathNormalization(tt.lowercase, mux), tt.path, nil)
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("lowercase=%v %s: got %q, want %q", tt.lowercase, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name+" in")
+				next.ServeHTTP(w, r)
+				order = append(order, name+" out")
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mark("recovery"), nil, mark("logging"), mark("ratelimit"))
+
+	get(h, "/", nil)
+	want := []string{"recovery in", "logging in", "ratelimit in", "handler", "ratelimit out", "logging out", "recovery out"}
+	if !slices.Equal(order, want) {
+		t.Errorf("order = %q, want %q", order, want)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	stuck, release := make(chan struct{}), make(chan struct{})
+	defer close(stuck)
+	// The timed-out handler ignores its context: one that answered as
+	// soon as it was cancelled could beat the timeout response.
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/parking/nearest" {
+			<-stuck
+		} else {
+			<-release
+		}
+		io.WriteString(w, "late")
+	})
+	h := withRequestTimeout(50*time.Millisecond, slow)
+
+	rec := get(h, "/api/parking/nearest", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if got := errorCode(rec.Body.Bytes()); got != errCodeRequestTimeout {
+		t.Errorf("error code = %q, want %q", got, errCodeRequestTimeout)
+	}
+
+	// Event streams and static files are left alone.
+	for _, req := range []struct {
+		path   string
+		header http.Header
+	}{
+		{path: "/api/parking/live", header: http.Header{"Accept": {eventStreamType}}},
+		{path: "/assets/app.js"},
+	} {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- get(h, req.path, req.header) }()
+		time.Sleep(100 * time.Millisecond)
+		release <- struct{}{}
+		if rec := <-done; rec.Code != http.StatusOK || rec.Body.String() != "late" {
+			t.Errorf("%s: got %d %q, want the handler's response", req.path, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "served")
+	})
+	tests := []struct {
+		canonical string
+		url       string
+		proto     string
+		wantCode  int
+		wantLoc   string
+	}{
+		{canonical: "parking.example.com", url: "http://legacy.example.org/api/parking/nearest?lat=1&lng=2", wantCode: 301, wantLoc: "http://parking.example.com/api/parking/nearest?lat=1&lng=2"},
+		{canonical: "parking.example.com", url: "http://legacy.example.org/map/", proto: "https", wantCode: 301, wantLoc: "https://parking.example.com/map/"},
+		{canonical: "parking.example.com", url: "http://Parking.Example.com/map/", wantCode: 200},
+		{canonical: "parking.example.com", url: "http://10.0.0.5/healthz", wantCode: 200},
+		{canonical: "", url: "http://legacy.example.org/", wantCode: 200},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		rec := httptest.NewRecorder()
+		withCanonicalHost(tt.canonical, true, ok).ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.url, rec.Code, tt.wantCode)
+		}
+		if got := rec.Header().Get("Location"); got != tt.wantLoc {
+			t.Errorf("%s: Location = %q, want %q", tt.url, got, tt.wantLoc)
+		}
+	}
+}
+
+func TestLogSamplingKeepsErrorsAndSlowRequests(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	h := withLogging(logger, 0.1, 20*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusBadGateway)
+		case "/slow":
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	serve := func(path string, n int) {
+		for range n {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		}
+	}
+	serve("/fail", 50)
+	serve("/slow", 3)
+	serve("/ok", 1000)
+
+	logged := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		for _, path := range []string{"/fail", "/slow", "/ok"} {
+			if strings.Contains(line, "path="+path+" ") {
+				logged[path]++
+			}
+		}
+	}
+	if logged["/fail"] != 50 {
+		t.Errorf("logged %d of 50 failed requests, want all", logged["/fail"])
+	}
+	if logged["/slow"] != 3 {
+		t.Errorf("logged %d of 3 slow requests, want all", logged["/slow"])
+	}
+	// About 100 are expected, with a standard deviation under 10.
+	if n := logged["/ok"]; n < 50 || n > 150 {
+		t.Errorf("logged %d of 1000 successful requests at a 0.1 sample rate", n)
+	}
+}
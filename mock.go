@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// mockHandler answers an API route with the canned JSON in dir/name.json
+// instead of calling its upstream. Fixtures are read on every request so
+// they can be edited while the gateway runs.
+func mockHandler(dir, name string) http.HandlerFunc {
+	file := filepath.Join(dir, name+".json")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "only GET and HEAD are supported")
+			return
+		}
+		body, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			writeJSONError(w, http.StatusNotImplemented, errCodeMockMissing, "mock mode: no fixture "+file)
+			return
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "mock mode: "+err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("X-Mock", "true")
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+	}
+}
@@ -0,0 +1,1121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const retryBaseDelay = 100 * time.Millisecond
+
+var (
+	errInvalidJSON = errors.New("upstream returned malformed JSON")
+	errNotJSON     = errors.New("upstream response is not JSON")
+	// errTransformFailed wraps errors returned by a ResponseTransformer.
+	errTransformFailed = errors.New("response transform failed")
+)
+
+// hopHeaders are the RFC 7230 hop-by-hop headers a proxy must not forward.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy relays GET requests to a single upstream endpoint.
+type Proxy struct {
+	// Name labels the route in metrics.
+	Name   string
+	Target string
+	// StripPrefix, when set, makes Target a base URL: the request path
+	// with this prefix removed is appended to it.
+	StripPrefix string
+	Client      *http.Client
+	MaxRetries  int
+	Cache       *responseCache
+	// Coalesce, when set, shares one buffered upstream fetch between
+	// concurrent identical requests.
+	Coalesce *flightGroup
+	CORS     *corsPolicy
+	// TrustForwarded keeps client-supplied X-Forwarded-* headers instead
+	// of replacing them.
+	TrustForwarded bool
+	// RequestIDHeader names the header carrying the request ID upstream.
+	RequestIDHeader string
+	Breaker         *circuitBreaker
+	// ValidateQuery, when set, returns the names of invalid query
+	// parameters; a non-empty result rejects the request with 400.
+	ValidateQuery func(url.Values) []string
+	// ForwardAuth relays the client's Authorization header to Target.
+	// Authorized requests bypass Cache and Coalesce so responses are never
+	// shared between callers.
+	ForwardAuth bool
+	// Limit bounds concurrent calls to the upstream.
+	Limit *semaphore
+	// MaxResponseBytes caps how much of an upstream body is relayed or
+	// buffered; zero means no limit.
+	MaxResponseBytes int64
+	// Pool, when set, spreads requests over equivalent copies of Target
+	// and fails over between them on connection errors.
+	Pool *upstreamPool
+	// Canary, when set, serves CanaryWeight percent of requests, picked
+	// at random. Responses name the instance in X-Upstream.
+	Canary       *Proxy
+	CanaryWeight int
+	// NormalizeQuery, when set, rewrites the query before it forms the
+	// cache key and the upstream request.
+	NormalizeQuery func(url.Values)
+	// AllowedParams, when set, names the only query parameters forwarded
+	// upstream; others are dropped. Parameters read by Transformers are
+	// always kept for them.
+	AllowedParams map[string]bool
+	// DefaultQuery is added to every upstream request; parameters the
+	// client set take precedence.
+	DefaultQuery url.Values
+	// Transformers post-process successful response bodies, in order.
+	// Setting any makes the route buffer those responses instead of
+	// streaming them. Add them with AddTransformer.
+	Transformers []ResponseTransformer
+	// EnforceJSON answers 502 when a 2xx response is not application/json.
+	EnforceJSON bool
+	// Timeout bounds each upstream call, including reading the body; zero
+	// means no limit. Event streams are exempt.
+	Timeout time.Duration
+	// SlowThreshold, when positive, logs a warning for upstream calls that
+	// take longer, whatever their outcome.
+	SlowThreshold time.Duration
+	// HostOverride, when set, replaces the Host header sent upstream so
+	// the request can pass through a virtual-host ingress.
+	HostOverride string
+	// Methods lists the methods the route accepts; empty means GET and
+	// HEAD. OPTIONS is always answered for CORS preflight. Bodies of
+	// methods other than GET and HEAD, up to MaxRequestBytes, are
+	// forwarded upstream.
+	Methods         []string
+	MaxRequestBytes int64
+	// ForwardHeaders names client headers copied onto upstream requests.
+	// Their values are part of the cache and coalescing keys.
+	ForwardHeaders []string
+	// RetryJitter randomizes the delay before each retry.
+	RetryJitter bool
+	// RetryBudget, when set, caps retries across all routes sharing it.
+	RetryBudget *retryBudget
+	// BasicAuth, in user:password form, authenticates every upstream
+	// request, replacing any forwarded Authorization header.
+	BasicAuth string
+}
+
+// bufferedResponse is an upstream response read fully into memory.
+type bufferedResponse struct {
+	status    int
+	header    http.Header
+	body      []byte
+	truncated bool
+}
+
+func (p *Proxy) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			proxyMetrics.observeRequest(p.Name, metricStatus(rw, r))
+		}()
+		p.serve(rw, r)
+	}
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) {
+	if p.Canary != nil {
+		if rand.IntN(100) < p.CanaryWeight {
+			w.Header().Set("X-Upstream", "canary")
+			p.Canary.serve(w, r)
+			return
+		}
+		w.Header().Set("X-Upstream", "stable")
+	}
+	if r.Method == http.MethodOptions {
+		p.CORS.preflight(w, r, p.allowedMethods())
+		return
+	}
+	if !p.allows(r.Method) {
+		w.Header().Set("Allow", p.allowedMethods())
+		writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "supported methods: "+p.allowedMethods())
+		return
+	}
+	if p.AllowedParams != nil {
+		editQuery(r, p.filterParams)
+	}
+	if !p.validQuery(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !p.bufferBody(w, r) {
+		return
+	}
+	p.normalizeQuery(r)
+
+	// Only plain GETs are shared: HEAD requests and event streams are
+	// relayed unbuffered, and requests with a body are never repeated.
+	shared := r.Method == http.MethodGet && !(p.ForwardAuth && r.Header.Get("Authorization") != "") &&
+		!wantsEventStream(r)
+	cache := p.Cache
+	if !shared {
+		cache = nil
+	}
+
+	// Keying on the sorted query lets parameter order vary between callers.
+	cacheKey := r.URL.Path + "?" + r.URL.Query().Encode() + p.forwardedKey(r)
+	if cache != nil {
+		if e, ok := cache.Get(cacheKey, r.Header); ok {
+			proxyMetrics.observeCache(p.Name, "hit")
+			p.writeBuffered(w, r, &e.bufferedResponse, "HIT")
+			return
+		}
+		proxyMetrics.observeCache(p.Name, "miss")
+	}
+
+	proxyURL := p.upstreamURL(r)
+	setUpstream(r.Context(), proxyURL)
+
+	if p.Coalesce != nil && shared {
+		// The shared fetch must outlive any single waiter's client.
+		ctx := context.WithoutCancel(r.Context())
+		start := time.Now()
+		// The key carries the gateway's parameters too: they are not in
+		// proxyURL but change the transformed body.
+		key := http.MethodGet + " " + proxyURL + p.forwardedKey(r) + p.gatewayKey(r)
+		br, err := p.Coalesce.Do(key, func() (*bufferedResponse, error) {
+			br, err := p.fetchBuffered(ctx, withoutConditionals(r), proxyURL)
+			if err == nil && p.transforms(r, br.status, br.header) {
+				if br.body, err = p.transform(r, br.body, br.header); err != nil {
+					br = nil
+				}
+			}
+			return br, err
+		})
+		proxyMetrics.observeUpstream(p.Name, time.Since(start))
+		if upstreamFailed(br, err) && p.serveStale(w, r, cache, cacheKey, err) {
+			return
+		}
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		cacheStatus := ""
+		if cache != nil {
+			cacheStatus = "MISS"
+			if br.status == http.StatusOK && !br.truncated && len(br.body) <= maxCachedBodyBytes {
+				cache.Set(cacheKey, r.Header, br)
+			}
+		}
+		p.writeBuffered(w, r, br, cacheStatus)
+		return
+	}
+
+	start := time.Now()
+	resp, err := p.fetch(r.Context(), r, proxyURL)
+	proxyMetrics.observeUpstream(p.Name, time.Since(start))
+	if (err != nil || resp.StatusCode >= 500) && p.serveStale(w, r, cache, cacheKey, err) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return
+	}
+	if err != nil {
+		writeUpstreamError(w, r, err)
+		return
+	}
+	defer drainClose(resp.Body)
+
+	if r.Method == http.MethodHead {
+		copyHeaders(w.Header(), resp.Header)
+		setContentLength(w.Header(), resp.ContentLength)
+		p.CORS.apply(w.Header(), r)
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+
+	if resp.StatusCode >= 400 {
+		// Error bodies are small; buffer them to check they are JSON.
+		capped := p.capBody(resp.Body)
+		buf, err := io.ReadAll(capped)
+		if err != nil {
+			writeUpstreamError(w, r, err)
+			return
+		}
+		if isErrorPage(resp.StatusCode, buf) {
+			p.writeErrorPage(w, r, resp.StatusCode, resp.Header)
+			return
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(buf))
+	}
+
+	copyHeaders(w.Header(), resp.Header)
+	// Framing is the server's job: only a length the client checked is
+	// passed on, and without one the body is sent chunked.
+	length := resp.ContentLength
+	if p.MaxResponseBytes > 0 && length > p.MaxResponseBytes {
+		length = -1
+	}
+	setContentLength(w.Header(), length)
+
+	if isEventStream(resp.Header) {
+		p.CORS.apply(w.Header(), r)
+		w.Header().Del("Content-Length")
+		w.WriteHeader(resp.StatusCode)
+		src := &upstreamReader{Reader: resp.Body}
+		logCopyError(r, proxyURL, src, copyFlushing(w, src))
+		return
+	}
+
+	capped := p.capBody(resp.Body)
+	var body io.Reader = capped
+	if p.transforms(r, resp.StatusCode, w.Header()) {
+		buf, err := io.ReadAll(body)
+		if err == nil {
+			buf, err = p.transform(r, buf, w.Header())
+		}
+		if err != nil {
+			for key := range resp.Header {
+				w.Header().Del(key)
+			}
+			if !p.serveStale(w, r, cache, cacheKey, err) {
+				writeUpstreamError(w, r, err)
+			}
+			return
+		}
+		body = bytes.NewReader(buf)
+	}
+	if cache != nil {
+		if resp.StatusCode == http.StatusOK {
+			buf, err := io.ReadAll(io.LimitReader(body, maxCachedBodyBytes+1))
+			if err == nil && !capped.truncated && len(buf) <= maxCachedBodyBytes {
+				hdr := w.Header().Clone()
+				hdr.Del("Access-Control-Allow-Origin")
+				cache.Set(cacheKey, r.Header, &bufferedResponse{status: resp.StatusCode, header: hdr, body: buf})
+			}
+			body = io.MultiReader(bytes.NewReader(buf), body)
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+	p.CORS.apply(w.Header(), r)
+
+	w.WriteHeader(resp.StatusCode)
+	src := &upstreamReader{Reader: body}
+	_, err = io.Copy(w, src)
+	logCopyError(r, proxyURL, src, err)
+	if capped.truncated {
+		slog.Warn("upstream response truncated", "upstream", proxyURL, "limit_bytes", p.MaxResponseBytes)
+	}
+}
+
+// upstreamReader remembers why reading the upstream body failed, so a
+// failed copy can be blamed on the upstream or on the client.
+type upstreamReader struct {
+	io.Reader
+	err error
+}
+
+func (u *upstreamReader) Read(b []byte) (int, error) {
+	n, err := u.Reader.Read(b)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+// logCopyError records why relaying a response body stopped early. The
+// status has already been sent, so there is nothing left to tell the
+// client.
+func logCopyError(r *http.Request, proxyURL string, src *upstreamReader, err error) {
+	if err == nil {
+		return
+	}
+	if r.Context().Err() != nil || src.err == nil {
+		slog.Debug("client went away mid-response", "request_id", requestIDFrom(r.Context()), "upstream", proxyURL, "err", err)
+		return
+	}
+	slog.Warn("upstream body read failed mid-response", "request_id", requestIDFrom(r.Context()), "upstream", proxyURL, "err", src.err)
+}
+
+// maxDrainBytes bounds how much of an unread upstream body is discarded
+// to keep its connection reusable; longer bodies are cut off instead.
+const maxDrainBytes = 64 << 10
+
+// drainClose discards what is left of body, up to maxDrainBytes, and
+// closes it.
+func drainClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+	body.Close()
+}
+
+func (p *Proxy) allows(method string) bool {
+	for _, m := range p.methods() {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) methods() []string {
+	if len(p.Methods) == 0 {
+		return []string{http.MethodGet, http.MethodHead}
+	}
+	return p.Methods
+}
+
+// allowedMethods is the value of the Allow header for the route.
+func (p *Proxy) allowedMethods() string {
+	methods := append([]string(nil), p.methods()...)
+	return strings.Join(append(methods, http.MethodOptions), ", ")
+}
+
+// bufferBody reads the request body, up to MaxRequestBytes, so it can be
+// forwarded and replayed on retries. It answers 413 when the body is too
+// large.
+func (p *Proxy) bufferBody(w http.ResponseWriter, r *http.Request) bool {
+	body := r.Body
+	if p.MaxRequestBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, p.MaxRequestBytes)
+	}
+	buf, err := io.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge,
+				fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit))
+			return false
+		}
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidBody, "could not read request body")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	r.ContentLength = int64(len(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return true
+}
+
+// filterParams drops parameters not in AllowedParams from q, keeping the
+// gateway's own.
+func (p *Proxy) filterParams(q url.Values) {
+	if p.AllowedParams == nil {
+		return
+	}
+	gateway := p.gatewayParams()
+	for key := range q {
+		if !p.AllowedParams[key] && !slices.Contains(gateway, key) {
+			delete(q, key)
+		}
+	}
+}
+
+// gatewayKey encodes the values of the gateway's parameters in r, which
+// tell apart requests that differ only in how the response is transformed.
+func (p *Proxy) gatewayKey(r *http.Request) string {
+	q := r.URL.Query()
+	own := url.Values{}
+	for _, name := range p.gatewayParams() {
+		if values, ok := q[name]; ok {
+			own[name] = values
+		}
+	}
+	if len(own) == 0 {
+		return ""
+	}
+	return "\n" + own.Encode()
+}
+
+// upstreamURL is Target, followed by the rest of the request path when
+// StripPrefix is set, with the client's allowed parameters, less the
+// gateway's own, plus any DefaultQuery parameters the client did not
+// set. The query is built as url.Values and encoded once, so it is well
+// formed however many parameters were added or removed.
+func (p *Proxy) upstreamURL(r *http.Request) string {
+	target := p.Target
+	if p.StripPrefix != "" {
+		if rest := strings.TrimPrefix(r.URL.EscapedPath(), p.StripPrefix); rest != "" {
+			target = strings.TrimSuffix(target, "/") + "/" + strings.TrimPrefix(rest, "/")
+		}
+	}
+	q := r.URL.Query()
+	p.filterParams(q)
+	for _, name := range p.gatewayParams() {
+		q.Del(name)
+	}
+	for key, values := range p.DefaultQuery {
+		if !q.Has(key) {
+			q[key] = append([]string(nil), values...)
+		}
+	}
+	if len(q) == 0 {
+		return target
+	}
+	return target + "?" + q.Encode()
+}
+
+// editQuery applies edit to the parameters of r and re-encodes them.
+func editQuery(r *http.Request, edit func(url.Values)) {
+	q := r.URL.Query()
+	edit(q)
+	r.URL.RawQuery = q.Encode()
+}
+
+func (p *Proxy) normalizeQuery(r *http.Request) {
+	if p.NormalizeQuery == nil || r.URL.RawQuery == "" {
+		return
+	}
+	editQuery(r, p.NormalizeQuery)
+}
+
+func (p *Proxy) validQuery(w http.ResponseWriter, r *http.Request) bool {
+	if p.ValidateQuery == nil {
+		return true
+	}
+	if invalid := p.ValidateQuery(r.URL.Query()); len(invalid) > 0 {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidParams, "missing or invalid query parameters: "+strings.Join(invalid, ", "))
+		return false
+	}
+	return true
+}
+
+// metricStatus reports 499 for requests abandoned by the client before any
+// response was written.
+func metricStatus(rw *responseWriter, r *http.Request) int {
+	if rw.status != 0 {
+		return rw.status
+	}
+	if r.Context().Err() != nil {
+		return 499
+	}
+	return http.StatusOK
+}
+
+// fetch issues the outbound request for the incoming request in.
+func (p *Proxy) fetch(ctx context.Context, in *http.Request, proxyURL string) (*http.Response, error) {
+	if p.Timeout <= 0 || wantsEventStream(in) {
+		return p.roundTrip(ctx, in, proxyURL)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	resp, err := p.roundTrip(ctx, in, proxyURL)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The deadline also covers reading the body, so it ends with Close.
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (p *Proxy) roundTrip(ctx context.Context, in *http.Request, proxyURL string) (*http.Response, error) {
+	method := in.Method
+	var body io.ReadCloser
+	if in.GetBody != nil {
+		b, err := in.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	req, err := http.NewRequestWithContext(ctx, method, proxyURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.GetBody = in.GetBody
+		req.ContentLength = in.ContentLength
+		for _, h := range []string{"Content-Type", "Idempotency-Key"} {
+			if v := in.Header.Get(h); v != "" {
+				req.Header.Set(h, v)
+			}
+		}
+	}
+	if p.HostOverride != "" {
+		req.Host = p.HostOverride
+	}
+	if wantsEventStream(in) {
+		req.Header.Set("Accept", eventStreamType)
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	setForwardedHeaders(req, in, p.TrustForwarded)
+	if id := requestIDFrom(in.Context()); id != "" && p.RequestIDHeader != "" {
+		req.Header.Set(p.RequestIDHeader, id)
+	}
+	// Outbound URLs are always built from Target, so the header only ever
+	// reaches the configured origin; the client drops it on cross-host
+	// redirects.
+	if auth := in.Header.Get("Authorization"); p.ForwardAuth && auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if user, pass, ok := strings.Cut(p.BasicAuth, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	for _, h := range conditionalHeaders {
+		if v := in.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	for _, h := range p.ForwardHeaders {
+		for _, v := range in.Header.Values(h) {
+			req.Header.Add(h, v)
+		}
+	}
+
+	if err := p.Limit.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer p.Limit.release()
+
+	if !p.Breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	span := startClientSpan(in.Context(), method+" "+p.Name)
+	span.setAttr("url.full", proxyURL)
+	span.inject(req.Header)
+	slog.Debug("upstream request",
+		"request_id", requestIDFrom(in.Context()),
+		"route", p.Name,
+		"method", method,
+		"url", proxyURL,
+		"headers", redactHeaders(req.Header),
+	)
+	start := time.Now()
+	resp, err := p.doWithRetry(req)
+	if err == nil {
+		slog.Debug("upstream response",
+			"request_id", requestIDFrom(in.Context()),
+			"route", p.Name,
+			"status", resp.StatusCode,
+			"headers", redactHeaders(resp.Header),
+		)
+	}
+	if elapsed := time.Since(start); p.SlowThreshold > 0 && elapsed > p.SlowThreshold {
+		slog.Warn("slow upstream request",
+			"request_id", requestIDFrom(in.Context()),
+			"route", p.Name,
+			"query", in.URL.RawQuery,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+		)
+	}
+	if err != nil {
+		span.setAttr("error.type", err.Error())
+		span.setError()
+	} else {
+		span.setAttr("http.response.status_code", resp.StatusCode)
+		if resp.StatusCode >= 500 {
+			span.setError()
+		}
+	}
+	span.finish()
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// The client went away; that says nothing about the upstream.
+		p.Breaker.abort()
+	} else {
+		p.Breaker.record(err == nil && resp.StatusCode < 500)
+	}
+	if resp != nil && p.RequestIDHeader != "" {
+		// The gateway already echoes its own request ID.
+		resp.Header.Del(p.RequestIDHeader)
+	}
+	if err == nil && p.unexpectedType(in, resp) {
+		slog.Warn("upstream returned unexpected content type", "upstream", proxyURL, "status", resp.StatusCode, "content_type", resp.Header.Get("Content-Type"))
+		resp.Body.Close()
+		return nil, errNotJSON
+	}
+	return resp, err
+}
+
+// unexpectedType reports whether EnforceJSON is on and a 2xx response is
+// not application/json. Event streams the client asked for are exempt.
+func (p *Proxy) unexpectedType(in *http.Request, resp *http.Response) bool {
+	if !p.EnforceJSON || resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == http.StatusNoContent {
+		return false
+	}
+	if wantsEventStream(in) && isEventStream(resp.Header) {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err != nil || mediaType != "application/json"
+}
+
+func (p *Proxy) fetchBuffered(ctx context.Context, in *http.Request, proxyURL string) (*bufferedResponse, error) {
+	resp, err := p.fetch(ctx, in, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	defer drainClose(resp.Body)
+
+	capped := p.capBody(resp.Body)
+	body, err := io.ReadAll(capped)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	copyHeaders(header, resp.Header)
+	header.Del("Access-Control-Allow-Origin")
+	if capped.truncated {
+		slog.Warn("upstream response truncated", "upstream", proxyURL, "limit_bytes", p.MaxResponseBytes)
+		header.Del("Content-Length")
+	}
+	return &bufferedResponse{status: resp.StatusCode, header: header, body: body, truncated: capped.truncated}, nil
+}
+
+func (p *Proxy) capBody(body io.Reader) *cappedReader {
+	limit := p.MaxResponseBytes
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	return &cappedReader{r: body, n: limit}
+}
+
+// cappedReader stops after n bytes and records whether the source had
+// more to give.
+type cappedReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func (c *cappedReader) Read(b []byte) (int, error) {
+	if c.n <= 0 {
+		var probe [1]byte
+		if n, _ := c.r.Read(probe[:]); n > 0 {
+			c.truncated = true
+		}
+		return 0, io.EOF
+	}
+	if int64(len(b)) > c.n {
+		b = b[:c.n]
+	}
+	n, err := c.r.Read(b)
+	c.n -= int64(n)
+	return n, err
+}
+
+func writeUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeCircuitOpen, "upstream is temporarily disabled after repeated failures")
+		return
+	}
+	if errors.Is(err, errUpstreamBusy) {
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeUpstreamBusy, "upstream is at capacity, try again shortly")
+		return
+	}
+	if errors.Is(err, errInvalidJSON) {
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamInvalid, "upstream returned a malformed response")
+		return
+	}
+	if errors.Is(err, errTransformFailed) {
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamInvalid, "upstream response could not be processed")
+		return
+	}
+	if errors.Is(err, errNotJSON) {
+		writeJSONError(w, http.StatusBadGateway, errCodeUpstreamInvalid, "upstream returned an unexpected content type")
+		return
+	}
+	if isTimeout(err) {
+		writeJSONError(w, http.StatusGatewayTimeout, errCodeUpstreamTimeout, "upstream did not respond in time")
+		return
+	}
+	writeJSONError(w, http.StatusBadGateway, errCodeUpstreamUnavailable, "upstream is unavailable")
+}
+
+// upstreamFailed reports whether a fetch errored, an open circuit
+// included, or returned a 5xx.
+func upstreamFailed(br *bufferedResponse, err error) bool {
+	return err != nil || br.status >= 500
+}
+
+// serveStale writes a stale cached entry for key, if one is still within
+// the cache's stale window, in place of the failure err. Entries served
+// because the circuit is open are marked X-Cache: STALE-CIRCUIT.
+func (p *Proxy) serveStale(w http.ResponseWriter, r *http.Request, cache *responseCache, key string, err error) bool {
+	if cache == nil || r.Context().Err() != nil {
+		return false
+	}
+	e, ok := cache.GetStale(key, r.Header)
+	if !ok {
+		return false
+	}
+	proxyMetrics.observeCache(p.Name, "stale")
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	status := "STALE"
+	if errors.Is(err, errCircuitOpen) {
+		status = "STALE-CIRCUIT"
+	}
+	p.writeBuffered(w, r, &e.bufferedResponse, status)
+	return true
+}
+
+func (p *Proxy) writeBuffered(w http.ResponseWriter, r *http.Request, br *bufferedResponse, cacheStatus string) {
+	if isErrorPage(br.status, br.body) {
+		p.writeErrorPage(w, r, br.status, br.header)
+		return
+	}
+	stored := make(http.Header, len(br.header))
+	for _, key := range sortedKeys(br.header) {
+		canonical := textproto.CanonicalMIMEHeaderKey(key)
+		stored[canonical] = append(stored[canonical], br.header[key]...)
+	}
+	for key, values := range stored {
+		w.Header()[key] = values
+	}
+	setContentLength(w.Header(), int64(len(br.body)))
+	p.CORS.apply(w.Header(), r)
+	if cacheStatus != "" {
+		w.Header().Set("X-Cache", cacheStatus)
+	}
+	if br.status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), br.header.Get("ETag")) {
+		writeNotModified(w)
+		return
+	}
+	w.WriteHeader(br.status)
+	w.Write(br.body)
+}
+
+// isErrorPage reports whether an upstream error response has a body the
+// frontend cannot parse, such as an HTML page from a crashed worker.
+func isErrorPage(status int, body []byte) bool {
+	return status >= 400 && !json.Valid(body)
+}
+
+// writeErrorPage replaces an upstream error page with the JSON error
+// envelope, keeping the upstream status and any Retry-After.
+func (p *Proxy) writeErrorPage(w http.ResponseWriter, r *http.Request, status int, header http.Header) {
+	if v := header.Get("Retry-After"); v != "" {
+		w.Header().Set("Retry-After", v)
+	}
+	p.CORS.apply(w.Header(), r)
+	writeJSONError(w, status, errCodeUpstreamError, fmt.Sprintf("upstream returned %d", status))
+}
+
+// forwardedKey distinguishes requests whose ForwardHeaders differ, so
+// responses to them are never shared.
+func (p *Proxy) forwardedKey(r *http.Request) string {
+	var b strings.Builder
+	for _, h := range p.ForwardHeaders {
+		for _, v := range r.Header.Values(h) {
+			b.WriteString("\n" + h + ": " + v)
+		}
+	}
+	return b.String()
+}
+
+// isHopHeader reports whether name is a hop-by-hop header.
+func isHopHeader(name string) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(h, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// copyHeaders adds src to dst, skipping hop-by-hop headers and any header
+// named in src's Connection header. Keys are copied in sorted order, so
+// names that differ only in case merge the same way every time.
+func copyHeaders(dst, src http.Header) {
+	skip := make(map[string]bool, len(hopHeaders))
+	for _, h := range hopHeaders {
+		skip[h] = true
+	}
+	for _, v := range src.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				skip[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(src) {
+		if skip[textproto.CanonicalMIMEHeaderKey(key)] {
+			continue
+		}
+		for _, value := range src[key] {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// sortedKeys returns the keys of h in sorted order.
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for key := range h {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setContentLength replaces any Content-Length in h with n, or removes it
+// when n is negative so the server chooses the framing.
+func setContentLength(h http.Header, n int64) {
+	h.Del("Content-Length")
+	if n >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+}
+
+// setForwardedHeaders sets X-Forwarded-For, -Proto and -Host on out. An
+// existing chain from the client is only kept when trusted.
+func setForwardedHeaders(out, in *http.Request, trusted bool) {
+	clientIP := remoteIP(in)
+
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	host := in.Host
+
+	chain := clientIP
+	if trusted {
+		if prior := strings.Join(in.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+			chain = prior + ", " + clientIP
+		}
+		if v := in.Header.Get("X-Forwarded-Proto"); v != "" {
+			proto = v
+		}
+		if v := in.Header.Get("X-Forwarded-Host"); v != "" {
+			host = v
+		}
+	}
+
+	out.Header.Set("X-Forwarded-For", chain)
+	out.Header.Set("X-Forwarded-Proto", proto)
+	out.Header.Set("X-Forwarded-Host", host)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the originating client address, taken from the first
+// X-Forwarded-For entry when proxy headers are trusted.
+func clientIP(r *http.Request, trusted bool) string {
+	if trusted {
+		if first, _, _ := strings.Cut(r.Header.Get("X-Forwarded-For"), ","); strings.TrimSpace(first) != "" {
+			return strings.TrimSpace(first)
+		}
+	}
+	return remoteIP(r)
+}
+
+func (p *Proxy) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+// doWithRetry retries idempotent requests on connection errors and 5xx
+// responses while RetryBudget allows. The last response or error is
+// returned once retries run out.
+func (p *Proxy) doWithRetry(req *http.Request) (*http.Response, error) {
+	delay := retryBaseDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := p.send(req)
+		if !shouldRetry(resp, err) {
+			// Only successes refill the budget; timeouts and client
+			// errors are not retried but must not pay for retries either.
+			if err == nil && resp.StatusCode < 400 {
+				p.RetryBudget.deposit()
+			}
+			return resp, err
+		}
+		if attempt >= p.MaxRetries || !retryable(req) || !p.RetryBudget.withdraw() {
+			return resp, err
+		}
+		if resp != nil {
+			drainClose(resp.Body)
+		}
+
+		timer := time.NewTimer(p.backoff(delay))
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		delay *= 2
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// backoff is the wait before a retry whose exponential interval is delay.
+// With RetryJitter it is drawn uniformly from [0, delay) so that requests
+// failing together do not retry in lockstep.
+func (p *Proxy) backoff(delay time.Duration) time.Duration {
+	if !p.RetryJitter {
+		return delay
+	}
+	return rand.N(delay)
+}
+
+// send issues req once. With a Pool, each target is tried in turn until
+// one accepts the connection.
+func (p *Proxy) send(req *http.Request) (*http.Response, error) {
+	if p.Pool == nil {
+		return p.client().Do(req)
+	}
+	var lastErr error
+	for _, idx := range p.Pool.order() {
+		u, err := targetURL(p.Pool.targets[idx], req.URL.RawQuery)
+		if err != nil {
+			return nil, err
+		}
+		out := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if out.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		out.URL = u
+		if p.HostOverride == "" {
+			out.Host = u.Host
+		}
+		resp, err := p.client().Do(out)
+		if err == nil || !isConnectError(err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		slog.Warn("upstream unreachable, failing over", "target", u.Host, "err", err)
+		p.Pool.markDown(idx)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// retryable reports whether req may be sent again. GET, HEAD and the other
+// idempotent methods always may; POST and PATCH only when the client made
+// them idempotent with an Idempotency-Key.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPatch:
+		return req.Header.Get("Idempotency-Key") != ""
+	}
+	return true
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !isTimeout(err)
+	}
+	return resp.StatusCode >= 500
+}
+
+// dnsRetries is how many times a dial is repeated after the upstream's
+// name failed to resolve, as it may while a container network comes up.
+const dnsRetries = 3
+
+// retryDNS wraps d so that name resolution failures are retried with
+// backoff. Other dial errors are returned at once.
+func retryDNS(d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		delay := retryBaseDelay
+		for attempt := 0; ; attempt++ {
+			conn, err := d.DialContext(ctx, network, addr)
+			var dnsErr *net.DNSError
+			if err == nil || attempt >= dnsRetries || !errors.As(err, &dnsErr) {
+				return conn, err
+			}
+			slog.Debug("upstream name did not resolve, retrying", "addr", addr, "attempt", attempt+1, "err", err)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+			delay *= 2
+		}
+	}
+}
+
+// newUpstreamClient returns the client shared by all routes. Request
+// deadlines come from each Proxy's Timeout. Idle connections are kept
+// generously, since every request goes to the same few hosts. Unless
+// FollowRedirects is set, upstream redirects are relayed to the client
+// rather than followed, so the gateway never fetches from an origin it
+// was not configured with.
+func newUpstreamClient(cfg *Config) *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: retryDNS(&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}),
+		MaxIdleConns:        cfg.MaxIdleConns,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	}
+	client := &http.Client{Transport: transport}
+	if !cfg.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return client
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// redactHeaders returns h for debug logging, with credentials masked.
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"} {
+		if _, ok := out[name]; ok {
+			out[name] = []string{"[redacted]"}
+		}
+	}
+	return out
+}
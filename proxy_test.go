@@ -0,0 +1,1004 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a proxy to target with the settings every route
+// shares left at their zero values.
+func newTestProxy(target string) *Proxy {
+	return &Proxy{Name: "test", Target: target, Client: &http.Client{}}
+}
+
+func TestProxyCancelsUpstreamWhenClientGoesAway(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	gateway := httptest.NewServer(newTestProxy(upstream.URL).Handler())
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, gateway.URL, nil)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := http.DefaultClient.Do(req)
+		errc <- err
+	}()
+
+	<-started
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream request was not cancelled with the client's")
+	}
+	if err := <-errc; err == nil {
+		t.Error("client request succeeded after being cancelled")
+	}
+}
+
+func TestProxyRelaysAndMapsErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("delay") != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"ok":true}`)
+	}))
+	defer upstream.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		target     string
+		method     string
+		query      string
+		timeout    time.Duration
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "get passthrough", target: upstream.URL, method: http.MethodGet, wantStatus: http.StatusOK, wantBody: `{"ok":true}`},
+		{name: "method not allowed", target: upstream.URL, method: http.MethodPost, wantStatus: http.StatusMethodNotAllowed},
+		{name: "unreachable upstream", target: closed.URL, method: http.MethodGet, wantStatus: http.StatusBadGateway},
+		{name: "upstream timeout", target: upstream.URL, method: http.MethodGet, query: "?delay=1", timeout: 50 * time.Millisecond, wantStatus: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy(tt.target)
+			p.Timeout = tt.timeout
+			rec := httptest.NewRecorder()
+			p.Handler()(rec, httptest.NewRequest(tt.method, "/api/nearest"+tt.query, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantStatus == http.StatusMethodNotAllowed {
+				if got := rec.Header().Get("Allow"); got != "GET, HEAD, OPTIONS" {
+					t.Errorf("Allow = %q, want %q", got, "GET, HEAD, OPTIONS")
+				}
+			}
+		})
+	}
+}
+
+func TestCopyHeadersDropsHopByHop(t *testing.T) {
+	src := http.Header{}
+	src.Set("Connection", "close, X-Internal")
+	src.Set("Transfer-Encoding", "chunked")
+	src.Set("Keep-Alive", "timeout=5")
+	src.Set("X-Internal", "secret")
+	src.Set("Content-Type", "application/json")
+	src.Set("X-Parking-Source", "epo")
+
+	dst := http.Header{}
+	copyHeaders(dst, src)
+
+	for _, h := range []string{"Connection", "Transfer-Encoding", "Keep-Alive", "X-Internal"} {
+		if v := dst.Get(h); v != "" {
+			t.Errorf("%s = %q, want it dropped", h, v)
+		}
+	}
+	for h, want := range map[string]string{"Content-Type": "application/json", "X-Parking-Source": "epo"} {
+		if got := dst.Get(h); got != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+}
+
+func TestProxyCoalescesConcurrentRequests(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"free":3}`)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	p.Coalesce = &flightGroup{}
+	h := p.Handler()
+
+	const n = 50
+	var wg sync.WaitGroup
+	codes := make([]int, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/api/occupancy?id=42", nil))
+			codes[i] = rec.Code
+		}()
+	}
+	// Give every request time to join the flight before it lands.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hit %d times, want 1", got)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: status = %d, want 200", i, code)
+		}
+	}
+}
+
+func TestProxyAnswersPreflightWithoutUpstream(t *testing.T) {
+	var hits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/nearest", nil)
+	req.Header.Set("Origin", "https://parking.example")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "X-Request-Id")
+	rec := httptest.NewRecorder()
+	newTestProxy(upstream.URL).Handler()(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want 204", rec.Code)
+	}
+	for h, want := range map[string]string{
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers": "X-Request-Id",
+		"Access-Control-Max-Age":       "600",
+	} {
+		if got := rec.Header().Get(h); got != want {
+			t.Errorf("%s = %q, want %q", h, got, want)
+		}
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("upstream hit %d times, want 0", got)
+	}
+}
+
+func TestProxySetsForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		trusted   bool
+		wantFor   string
+		wantProto string
+		wantHost  string
+	}{
+		{name: "untrusted", trusted: false, wantFor: "192.0.2.1", wantProto: "http", wantHost: "gateway.example"},
+		{name: "trusted", trusted: true, wantFor: "203.0.113.7, 192.0.2.1", wantProto: "https", wantHost: "parking.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Clone()
+			}))
+			defer upstream.Close()
+			p := newTestProxy(upstream.URL)
+			p.TrustForwarded = tt.trusted
+
+			req := httptest.NewRequest(http.MethodGet, "http://gateway.example/api/nearest", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7")
+			req.Header.Set("X-Forwarded-Proto", "https")
+			req.Header.Set("X-Forwarded-Host", "parking.example")
+			p.Handler()(httptest.NewRecorder(), req)
+
+			for h, want := range map[string]string{
+				"X-Forwarded-For":   tt.wantFor,
+				"X-Forwarded-Proto": tt.wantProto,
+				"X-Forwarded-Host":  tt.wantHost,
+			} {
+				if v := got.Get(h); v != want {
+					t.Errorf("%s = %q, want %q", h, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyForwardsAuthorizationOnlyWhenEnabled(t *testing.T) {
+	for _, forward := range []bool{false, true} {
+		var got string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Get("Authorization")
+		}))
+		p := newTestProxy(upstream.URL)
+		p.ForwardAuth = forward
+		req := httptest.NewRequest(http.MethodGet, "/api/nearest", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		p.Handler()(httptest.NewRecorder(), req)
+		upstream.Close()
+
+		want := ""
+		if forward {
+			want = "Bearer token"
+		}
+		if got != want {
+			t.Errorf("ForwardAuth=%v: upstream Authorization = %q, want %q", forward, got, want)
+		}
+	}
+}
+
+func TestProxyRelaysNotModified(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"free":3}`)
+	}))
+	defer upstream.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/nearest", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rec := httptest.NewRecorder()
+	newTestProxy(upstream.URL).Handler()(rec, req)
+
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("status = %d, want 304", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("304 has a %d byte body", rec.Body.Len())
+	}
+}
+
+// errorCode returns the code of the JSON error envelope in body, or "" if
+// body is not one.
+func errorCode(body []byte) string {
+	var envelope map[string]jsonError
+	if json.Unmarshal(body, &envelope) != nil {
+		return ""
+	}
+	return envelope["error"].Code
+}
+
+func TestProxyWrapsNonJSONErrorPages(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		wantBody    string
+		wantCode    string
+	}{
+		{name: "html 500", status: 500, contentType: "application/json", body: "<html><h1>Internal Server Error</h1></html>", wantCode: errCodeUpstreamError},
+		{name: "json 404", status: 404, contentType: "application/json", body: `{"detail":"no such lot"}`, wantBody: `{"detail":"no such lot"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer upstream.Close()
+
+			rec := get(newTestProxy(upstream.URL).Handler(), "/api/nearest", nil)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+			if tt.wantCode != "" {
+				if got := errorCode(rec.Body.Bytes()); got != tt.wantCode {
+					t.Errorf("error code = %q in %q, want %q", got, rec.Body.String(), tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+// captureUpstream starts an upstream answering {} that records the last
+// request it received.
+func captureUpstream(t *testing.T) (*httptest.Server, func() *http.Request) {
+	var mu sync.Mutex
+	var last *http.Request
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		last = r.Clone(context.Background())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() *http.Request {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+}
+
+func TestProxyMergesDefaultQuery(t *testing.T) {
+	upstream, last := captureUpstream(t)
+	p := newTestProxy(upstream.URL)
+	p.DefaultQuery = url.Values{"source": {"frontend"}, "version": {"2"}}
+
+	tests := []struct {
+		query string
+		want  url.Values
+	}{
+		{query: "", want: url.Values{"source": {"frontend"}, "version": {"2"}}},
+		{query: "?lat=1", want: url.Values{"lat": {"1"}, "source": {"frontend"}, "version": {"2"}}},
+		{query: "?version=3", want: url.Values{"source": {"frontend"}, "version": {"3"}}},
+	}
+	for _, tt := range tests {
+		get(p.Handler(), "/api/nearest"+tt.query, nil)
+		if got := last().URL.Query(); got.Encode() != tt.want.Encode() {
+			t.Errorf("query %q: upstream got %q, want %q", tt.query, got.Encode(), tt.want.Encode())
+		}
+	}
+}
+
+func TestProxyHeadReturnsHeadersWithoutBody(t *testing.T) {
+	var method string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", "11")
+		if r.Method != http.MethodHead {
+			io.WriteString(w, `{"free":3}`+"\n")
+		}
+	}))
+	defer upstream.Close()
+	gateway := httptest.NewServer(newTestProxy(upstream.URL).Handler())
+	defer gateway.Close()
+
+	resp, err := http.Head(gateway.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if method != http.MethodHead {
+		t.Errorf("upstream method = %q, want HEAD", method)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.ContentLength != 11 {
+		t.Errorf("Content-Length = %d, want 11", resp.ContentLength)
+	}
+	if len(body) != 0 {
+		t.Errorf("HEAD returned %d body bytes", len(body))
+	}
+}
+
+func TestProxySendsHostOverride(t *testing.T) {
+	upstream, last := captureUpstream(t)
+	for _, override := range []string{"", "parser.internal"} {
+		p := newTestProxy(upstream.URL)
+		p.HostOverride = override
+		get(p.Handler(), "/api/nearest", nil)
+
+		want := override
+		if want == "" {
+			want = strings.TrimPrefix(upstream.URL, "http://")
+		}
+		if got := last().Host; got != want {
+			t.Errorf("HostOverride=%q: upstream Host = %q, want %q", override, got, want)
+		}
+	}
+}
+
+func TestProxyRetriesPostOnlyWithIdempotencyKey(t *testing.T) {
+	for _, key := range []string{"", "report-1"} {
+		var hits atomic.Int32
+		var gotKey string
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			gotKey = r.Header.Get("Idempotency-Key")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, `{}`)
+		}))
+		p := newTestProxy(upstream.URL)
+		p.Methods = []string{http.MethodPost}
+		p.MaxRetries = 2
+		p.RetryJitter = true
+
+		req := httptest.NewRequest(http.MethodPost, "/api/reports", strings.NewReader(`{"lot":1}`))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		p.Handler()(httptest.NewRecorder(), req)
+		upstream.Close()
+
+		want := int32(1)
+		if key != "" {
+			want = 3
+		}
+		if got := hits.Load(); got != want {
+			t.Errorf("Idempotency-Key=%q: upstream hit %d times, want %d", key, got, want)
+		}
+		if gotKey != key {
+			t.Errorf("upstream Idempotency-Key = %q, want %q", gotKey, key)
+		}
+	}
+}
+
+func TestProxyPerRouteTimeouts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer upstream.Close()
+
+	occupancy := newTestProxy(upstream.URL)
+	occupancy.Timeout = 50 * time.Millisecond
+	nearest := newTestProxy(upstream.URL)
+	nearest.Timeout = 300 * time.Millisecond
+
+	if rec := get(occupancy.Handler(), "/api/parking/occupancy", nil); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("short timeout: status = %d, want 504", rec.Code)
+	}
+	if rec := get(nearest.Handler(), "/api/parking/nearest", nil); rec.Code != http.StatusOK {
+		t.Errorf("long timeout: status = %d, want 200", rec.Code)
+	}
+}
+
+func TestProxyRedirects(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"moved":true}`)
+	}))
+	defer upstream.Close()
+
+	for _, follow := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.FollowRedirects = follow
+		p := newTestProxy(upstream.URL + "/old")
+		p.Client = newUpstreamClient(cfg)
+		rec := get(p.Handler(), "/api/nearest", nil)
+
+		if follow {
+			if rec.Code != http.StatusOK || rec.Body.String() != `{"moved":true}` {
+				t.Errorf("follow: got %d %q, want the redirect target", rec.Code, rec.Body.String())
+			}
+			continue
+		}
+		if rec.Code != http.StatusFound {
+			t.Errorf("no follow: status = %d, want 302", rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != "/new" {
+			t.Errorf("no follow: Location = %q, want /new", got)
+		}
+	}
+}
+
+func TestProxyAllowedParams(t *testing.T) {
+	upstream, last := captureUpstream(t)
+	p := newTestProxy(upstream.URL)
+	p.AllowedParams = map[string]bool{"lat": true, "lng": true, "radius": true}
+	p.AddTransformer(unitsTransformer{})
+
+	for _, query := range []string{
+		"lat=55.75&lng=37.61&radius=500&debug=1&page_size=100000",
+		"page_size=100000&radius=500&debug=1&lng=37.61&lat=55.75",
+		"units=imperial&radius=500&lng=37.61&lat=55.75",
+	} {
+		get(p.Handler(), "/api/nearest?"+query, nil)
+		if got, want := last().URL.RawQuery, "lat=55.75&lng=37.61&radius=500"; got != want {
+			t.Errorf("query %q: upstream got %q, want %q", query, got, want)
+		}
+	}
+
+	p.AllowedParams = nil
+	get(p.Handler(), "/api/nearest?debug=1&lat=55.75", nil)
+	if got, want := last().URL.RawQuery, "debug=1&lat=55.75"; got != want {
+		t.Errorf("without an allowlist: upstream got %q, want %q", got, want)
+	}
+}
+
+func TestProxyForwardsListedHeaders(t *testing.T) {
+	cfg := loadTestConfig(t, map[string]string{"FORWARD_HEADERS": "accept-language, Connection, Keep-Alive"})
+	if want := []string{"Accept-Language"}; !slices.Equal(cfg.ForwardHeaders, want) {
+		t.Fatalf("ForwardHeaders = %q, want %q", cfg.ForwardHeaders, want)
+	}
+
+	upstream, last := captureUpstream(t)
+	p := newTestProxy(upstream.URL)
+	p.ForwardHeaders = cfg.ForwardHeaders
+	get(p.Handler(), "/api/nearest", http.Header{
+		"Accept-Language": {"ru-RU"},
+		"Keep-Alive":      {"timeout=600"},
+	})
+	if got := last().Header.Get("Accept-Language"); got != "ru-RU" {
+		t.Errorf("upstream Accept-Language = %q, want ru-RU", got)
+	}
+	if got := last().Header.Get("Keep-Alive"); got != "" {
+		t.Errorf("upstream Keep-Alive = %q, want it not forwarded", got)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := &Proxy{RetryJitter: true}
+	seen := map[time.Duration]bool{}
+	for range 20 {
+		d := p.backoff(retryBaseDelay)
+		if d < 0 || d >= retryBaseDelay {
+			t.Fatalf("jittered delay %s outside [0, %s)", d, retryBaseDelay)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("20 jittered delays were all %v", seen)
+	}
+
+	p.RetryJitter = false
+	if d := p.backoff(retryBaseDelay); d != retryBaseDelay {
+		t.Errorf("delay without jitter = %s, want %s", d, retryBaseDelay)
+	}
+}
+
+func TestProxyEnforcesRouteMethods(t *testing.T) {
+	var method string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		methods   []string
+		method    string
+		wantAllow string
+	}{
+		{methods: nil, method: http.MethodGet},
+		{methods: nil, method: http.MethodDelete, wantAllow: "GET, HEAD, OPTIONS"},
+		{methods: []string{http.MethodGet, http.MethodPost}, method: http.MethodPost},
+		{methods: []string{http.MethodGet, http.MethodPost}, method: http.MethodPut, wantAllow: "GET, POST, OPTIONS"},
+	}
+	for _, tt := range tests {
+		method = ""
+		p := newTestProxy(upstream.URL)
+		p.Methods = tt.methods
+		rec := httptest.NewRecorder()
+		p.Handler()(rec, httptest.NewRequest(tt.method, "/api/reports", strings.NewReader("{}")))
+
+		if tt.wantAllow == "" {
+			if rec.Code != http.StatusOK || method != tt.method {
+				t.Errorf("%v %s: status %d, upstream saw %q; want it passed through", tt.methods, tt.method, rec.Code, method)
+			}
+			continue
+		}
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%v %s: status = %d, want 405", tt.methods, tt.method, rec.Code)
+		}
+		if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+			t.Errorf("%v %s: Allow = %q, want %q", tt.methods, tt.method, got, tt.wantAllow)
+		}
+		if method != "" {
+			t.Errorf("%v %s reached the upstream", tt.methods, tt.method)
+		}
+	}
+}
+
+func TestProxyBasicAuth(t *testing.T) {
+	upstream, last := captureUpstream(t)
+	for _, auth := range []string{"", "gateway:s3cret"} {
+		p := newTestProxy(upstream.URL)
+		p.BasicAuth = auth
+		rec := get(p.Handler(), "/api/nearest", nil)
+
+		user, pass, ok := last().BasicAuth()
+		if auth == "" {
+			if got := last().Header.Get("Authorization"); got != "" {
+				t.Errorf("unconfigured: upstream Authorization = %q, want none", got)
+			}
+			continue
+		}
+		if !ok || user+":"+pass != auth {
+			t.Errorf("upstream basic auth = %q:%q, want %q", user, pass, auth)
+		}
+		for key, values := range rec.Header() {
+			if strings.Contains(strings.Join(values, ","), "s3cret") {
+				t.Errorf("response header %s echoes the password", key)
+			}
+		}
+	}
+}
+
+func TestProxyLogsClientDisconnectMidStream(t *testing.T) {
+	logs := captureLogs(t)
+	upstreamDone := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(upstreamDone)
+		w.Header().Set("Content-Type", "application/json")
+		chunk := strings.Repeat("x", 32<<10)
+		for r.Context().Err() == nil {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+	served := make(chan struct{})
+	proxy := newTestProxy(upstream.URL).Handler()
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		proxy(w, r)
+	}))
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for name, done := range map[string]chan struct{}{"gateway handler": served, "upstream request": upstreamDone} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s still running after the client went away", name)
+		}
+	}
+	if out := logs.String(); !strings.Contains(out, "client went away mid-response") {
+		t.Errorf("disconnect not logged as the client's doing:\n%s", out)
+	}
+}
+
+func TestProxyRelaysChunkedBody(t *testing.T) {
+	want := strings.Repeat(`{"lot":1},`, 10000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i := 0; i < len(want); i += 4096 {
+			io.WriteString(w, want[i:min(i+4096, len(want))])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+	gateway := httptest.NewServer(newTestProxy(upstream.URL).Handler())
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if string(body) != want {
+		t.Errorf("got %d bytes, want the %d upstream sent", len(body), len(want))
+	}
+	if resp.ContentLength != -1 || !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+		t.Errorf("framing: Content-Length %d, Transfer-Encoding %q; want chunked", resp.ContentLength, resp.TransferEncoding)
+	}
+}
+
+// BenchmarkUpstreamConnectionChurn compares how many connections the
+// upstream client opens for bursts of concurrent requests, like the
+// frontend's on page load, with Go's default idle limits and with the
+// gateway's. Between bursts every connection goes idle, and those over the
+// per-host limit are closed. Run with:
+//
+//	go test -run '^$' -bench ConnectionChurn
+func BenchmarkUpstreamConnectionChurn(b *testing.B) {
+	const burst = 32
+	goDefaults := DefaultConfig()
+	goDefaults.MaxIdleConns = 100
+	goDefaults.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	for _, bench := range []struct {
+		name string
+		cfg  *Config
+	}{
+		{name: "go-defaults", cfg: goDefaults},
+		{name: "gateway-defaults", cfg: DefaultConfig()},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var conns atomic.Int64
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, `{"free":3}`)
+			}))
+			upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			upstream.Start()
+			defer upstream.Close()
+			p := newTestProxy(upstream.URL)
+			p.Client = newUpstreamClient(bench.cfg)
+			h := p.Handler()
+
+			b.ResetTimer()
+			for range b.N {
+				var wg sync.WaitGroup
+				for range burst {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						get(h, "/api/parking/occupancy", nil)
+					}()
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(conns.Load())/float64(b.N*burst), "conns/req")
+		})
+	}
+}
+
+func TestCopyHeadersIsDeterministic(t *testing.T) {
+	src := http.Header{
+		"x-parking-zone": {"a"},
+		"X-Parking-Zone": {"b"},
+		"X-PARKING-ZONE": {"c"},
+		"content-type":   {"application/json"},
+		"X-Trace":        {"1", "2"},
+	}
+	want := http.Header{
+		"X-Parking-Zone": {"c", "b", "a"},
+		"Content-Type":   {"application/json"},
+		"X-Trace":        {"1", "2"},
+	}
+	for range 50 {
+		dst := http.Header{}
+		copyHeaders(dst, src)
+		if !reflect.DeepEqual(dst, want) {
+			t.Fatalf("copyHeaders = %v, want %v", dst, want)
+		}
+	}
+}
+
+func TestProxyResponseHeadersAreByteIdentical(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-Zone", "X-Lot", "X-Area", "Cache-Control", "ETag", "X-Source"} {
+			w.Header().Set(name, "v-"+name)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{}`)
+	}))
+	defer upstream.Close()
+	gateway := httptest.NewServer(newTestProxy(upstream.URL).Handler())
+	defer gateway.Close()
+
+	rawHeaders := func() string {
+		conn, err := net.Dial("tcp", gateway.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET /api/nearest HTTP/1.1\r\nHost: gateway\r\nConnection: close\r\n\r\n")
+		raw, _ := io.ReadAll(conn)
+		head, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+		var lines []string
+		for _, line := range strings.Split(head, "\r\n") {
+			if !strings.HasPrefix(line, "Date:") {
+				lines = append(lines, line)
+			}
+		}
+		return strings.Join(lines, "\r\n")
+	}
+	first := rawHeaders()
+	for range 10 {
+		if got := rawHeaders(); got != first {
+			t.Fatalf("headers differ between identical responses:\n%s\n---\n%s", first, got)
+		}
+	}
+}
+
+func TestRetryBudgetCapsRetries(t *testing.T) {
+	var hits atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	p.MaxRetries = 3
+	p.RetryJitter = true
+	p.RetryBudget = newRetryBudget(0.1)
+	h := p.Handler()
+
+	// Nothing succeeds, so the budget never refills: however many
+	// requests fail, only the initial tokens are spent on retries.
+	const requests = 30
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/nearest", nil))
+		}()
+	}
+	wg.Wait()
+	if got, want := hits.Load(), int64(requests+retryBudgetInitial); got != want {
+		t.Errorf("upstream saw %d requests, want %d", got, want)
+	}
+
+	if _, _, denied := p.RetryBudget.snapshot(); denied == 0 {
+		t.Error("no retry was denied")
+	}
+
+	m := newMetrics()
+	m.setRetryBudget(p.RetryBudget)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"proxy_retry_budget_tokens 0",
+		`proxy_retries_total{result="allowed"} 10`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metrics lack %q:\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestRetryBudgetRefillsOnlyOnSuccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		hang   bool
+		want   float64
+	}{
+		{"timeout", 0, true, retryBudgetInitial},
+		{"not found", http.StatusNotFound, false, retryBudgetInitial},
+		{"too many requests", http.StatusTooManyRequests, false, retryBudgetInitial},
+		{"ok", http.StatusOK, false, retryBudgetInitial + 20*0.1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.hang {
+					<-r.Context().Done()
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer upstream.Close()
+			p := newTestProxy(upstream.URL)
+			p.MaxRetries = 3
+			p.Timeout = 20 * time.Millisecond
+			p.RetryBudget = newRetryBudget(0.1)
+			h := p.Handler()
+
+			for range 20 {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/nearest", nil))
+			}
+			if tokens, _, _ := p.RetryBudget.snapshot(); math.Abs(tokens-tt.want) > 1e-9 {
+				t.Errorf("budget has %g tokens after 20 calls, want %g", tokens, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamURLQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		allowed map[string]bool
+		def     url.Values
+		want    string
+	}{
+		{"no query", "/api/nearest", nil, nil, "http://upstream/nearest"},
+		{"add to empty", "/api/nearest", nil, url.Values{"radius": {"500"}}, "http://upstream/nearest?radius=500"},
+		{"add to existing", "/api/nearest?lat=55.7", nil, url.Values{"radius": {"500"}},
+			"http://upstream/nearest?lat=55.7&radius=500"},
+		{"remove all", "/api/nearest?debug=1&trace=on", map[string]bool{"lat": true}, nil, "http://upstream/nearest"},
+		{"repeated keys", "/api/nearest?lot=A&lot=B&debug=1", map[string]bool{"lot": true}, url.Values{"lot": {"C"}},
+			"http://upstream/nearest?lot=A&lot=B"},
+		{"escaping", "/api/nearest?q=a%26b+c", nil, nil, "http://upstream/nearest?q=a%26b+c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestProxy("http://upstream/nearest")
+			p.AllowedParams = tt.allowed
+			p.DefaultQuery = tt.def
+			if got := p.upstreamURL(httptest.NewRequest(http.MethodGet, tt.path, nil)); got != tt.want {
+				t.Errorf("upstreamURL(%s) = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEditQuery(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/nearest", nil)
+	editQuery(r, func(q url.Values) { q.Set("lat", "55.7") })
+	if got := r.URL.String(); got != "/api/nearest?lat=55.7" {
+		t.Errorf("after adding to an empty query: %s", got)
+	}
+	editQuery(r, func(q url.Values) { q.Del("lat") })
+	if got := r.URL.String(); got != "/api/nearest" {
+		t.Errorf("after removing every parameter: %s", got)
+	}
+}
+
+func TestCanaryWeight(t *testing.T) {
+	newUpstream := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"served_by":"`+name+`"}`)
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	p := newTestProxy(newUpstream("stable").URL)
+	p.Canary = newTestProxy(newUpstream("canary").URL)
+	p.CanaryWeight = 20
+	h := p.Handler()
+
+	// With 2000 requests the canary count has a standard deviation of
+	// about 18, so the bounds are more than five of them away.
+	const requests = 2000
+	counts := map[string]int{}
+	for range requests {
+		rec := get(h, "/api/parking/nearest", nil)
+		upstream := rec.Header().Get("X-Upstream")
+		if want := `{"served_by":"` + upstream + `"}`; rec.Body.String() != want {
+			t.Fatalf("X-Upstream %q on a response from %s", upstream, rec.Body.String())
+		}
+		counts[upstream]++
+	}
+	if c := counts["canary"]; c < 300 || c > 500 {
+		t.Errorf("canary served %d of %d requests, want about %d", c, requests, requests*p.CanaryWeight/100)
+	}
+	if counts["canary"]+counts["stable"] != requests {
+		t.Errorf("X-Upstream counts %v do not add up to %d", counts, requests)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitIdleTTL       = 3 * time.Minute
+	rateLimitSweepInterval = time.Minute
+)
+
+type visitor struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per-client-IP token bucket.
+type rateLimiter struct {
+	rps     float64
+	burst   float64
+	trusted bool
+
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+// newRateLimiter returns a limiter whose idle buckets are swept until ctx
+// is done.
+func newRateLimiter(ctx context.Context, rps float64, burst int, trusted bool) *rateLimiter {
+	l := &rateLimiter{
+		rps:      rps,
+		burst:    float64(burst),
+		trusted:  trusted,
+		visitors: make(map[string]*visitor),
+	}
+	go l.sweep(ctx)
+	return l
+}
+
+// setLimits changes the rate and burst; existing buckets keep their
+// tokens, capped at the new burst on their next request.
+func (l *rateLimiter) setLimits(rps float64, burst int) {
+	l.mu.Lock()
+	l.rps, l.burst = rps, float64(burst)
+	l.mu.Unlock()
+}
+
+// allow takes a token for key, or reports how long until one is available.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, ok := l.visitors[key]
+	if !ok {
+		v = &visitor{tokens: l.burst, last: now}
+		l.visitors[key] = v
+	}
+	v.tokens = math.Min(l.burst, v.tokens+now.Sub(v.last).Seconds()*l.rps)
+	v.last = now
+	if v.tokens >= 1 {
+		v.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - v.tokens) / l.rps * float64(time.Second))
+}
+
+func (l *rateLimiter) sweep(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.mu.Lock()
+			for key, v := range l.visitors {
+				if now.Sub(v.last) > rateLimitIdleTTL {
+					delete(l.visitors, key)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// wrap rate limits API requests; static files and operational endpoints
+// pass through untouched.
+func (l *rateLimiter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(clientIP(r, l.trusted))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, errCodeRateLimited, "too many requests, slow down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
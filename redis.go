@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisTimeout  = 500 * time.Millisecond
+	redisPoolSize = 16
+	// redisScanCount is how many keys each SCAN step of a flush asks for.
+	redisScanCount = 500
+)
+
+// redisCache is a cacheBackend on a Redis server, so replicas share
+// entries and a restart keeps them. Keys are namespaced by prefix. Redis
+// errors are logged and count as misses.
+type redisCache struct {
+	client *redisClient
+	prefix string
+}
+
+func newRedisCache(client *redisClient, prefix string) *redisCache {
+	return &redisCache{client: client, prefix: prefix}
+}
+
+// redisEntry is a cacheEntry as stored in Redis.
+type redisEntry struct {
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Expires time.Time   `json:"expires"`
+	Vary    []string    `json:"vary,omitempty"`
+}
+
+func (c *redisCache) Get(key string) (*cacheEntry, bool) {
+	reply, err := c.client.do("GET", c.prefix+key)
+	if err != nil {
+		slog.Warn("redis cache get failed", "addr", c.client.addr, "err", err)
+		return nil, false
+	}
+	raw, ok := reply.([]byte)
+	if !ok {
+		return nil, false
+	}
+	var stored redisEntry
+	if err := json.Unmarshal(raw, &stored); err != nil {
+		slog.Warn("redis cache entry unreadable", "addr", c.client.addr, "err", err)
+		return nil, false
+	}
+	return &cacheEntry{
+		bufferedResponse: bufferedResponse{status: stored.Status, header: stored.Header, body: stored.Body},
+		expires:          stored.Expires,
+		vary:             stored.Vary,
+	}, true
+}
+
+func (c *redisCache) Set(key string, e *cacheEntry, ttl time.Duration) {
+	raw, err := json.Marshal(redisEntry{
+		Status:  e.status,
+		Header:  e.header,
+		Body:    e.body,
+		Expires: e.expires,
+		Vary:    e.vary,
+	})
+	if err != nil {
+		return
+	}
+	ms := max(ttl.Milliseconds(), 1)
+	if _, err := c.client.do("SET", c.prefix+key, string(raw), "PX", strconv.FormatInt(ms, 10)); err != nil {
+		slog.Warn("redis cache set failed", "addr", c.client.addr, "err", err)
+	}
+}
+
+func (c *redisCache) Delete(key string) {
+	if _, err := c.client.do("DEL", c.prefix+key); err != nil {
+		slog.Warn("redis cache delete failed", "addr", c.client.addr, "err", err)
+	}
+}
+
+// Flush deletes every key under the prefix, SCAN batch by batch.
+func (c *redisCache) Flush() int {
+	removed := 0
+	cursor := "0"
+	for {
+		reply, err := c.client.do("SCAN", cursor, "MATCH", c.prefix+"*", "COUNT", strconv.Itoa(redisScanCount))
+		if err != nil {
+			slog.Warn("redis cache flush failed", "addr", c.client.addr, "err", err)
+			return removed
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return removed
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]any)
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, k := range keys {
+				if b, ok := k.([]byte); ok {
+					args = append(args, string(b))
+				}
+			}
+			if n, err := c.client.do(args...); err == nil {
+				if n, ok := n.(int64); ok {
+					removed += int(n)
+				}
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return removed
+		}
+	}
+}
+
+// redisClient speaks just enough RESP for the cache over a small pool of
+// connections.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server; the connection is still
+// usable after one.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisClient parses a redis://[:password@]host[:port][/db] URL.
+// Nothing is dialled until the first command.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Hostname() == "" {
+		return nil, errors.New("expected redis://[:password@]host[:port][/db]")
+	}
+	c := &redisClient{addr: u.Host, idle: make(chan *redisConn, redisPoolSize)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("database %q is not a number", db)
+		}
+	}
+	return c, nil
+}
+
+// do sends one command and returns its reply: a string, int64, []byte,
+// nil or []any.
+func (c *redisClient) do(args ...string) (any, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	reply, err := conn.command(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn takes an idle connection or dials a new one, authenticating and
+// selecting the database.
+func (c *redisClient) conn() (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if c.password != "" {
+		if _, err := conn.command("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (conn *redisConn) command(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+func (conn *redisConn) read() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = conn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
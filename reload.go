@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// reloadableSettings maps the Config fields a reload applies to their
+// environment variables. Everything else, the listener, TLS and the routes
+// included, needs a restart.
+var reloadableSettings = map[string]string{
+	"LogLevel":          "LOG_LEVEL",
+	"OccupancyCacheTTL": "OCCUPANCY_CACHE_TTL",
+	"NearestCacheTTL":   "NEAREST_CACHE_TTL",
+	"StaleIfError":      "STALE_IF_ERROR",
+	"MaintenanceMode":   "MAINTENANCE_MODE",
+	"RateLimitRPS":      "RATE_LIMIT_RPS",
+	"RateLimitBurst":    "RATE_LIMIT_BURST",
+}
+
+// liveSettings are the parts of a running server a reload changes.
+type liveSettings struct {
+	maintenance    *atomic.Bool
+	occupancyCache *responseCache
+	nearestCache   *responseCache // nil when the nearest cache is off
+	limiter        *rateLimiter
+}
+
+// Reload applies the reloadable settings of next that differ from the
+// ones in effect and returns their names. The changes are logged before
+// they apply, so raising the log level does not hide them. Changes to any
+// other setting are logged and ignored.
+func (s *Server) Reload(next *Config) []string {
+	prev := s.applied.Load()
+	var changed, ignored []string
+	before, after := prev.effective(), next.effective()
+	for name := range after {
+		if !reflect.DeepEqual(before[name], after[name]) {
+			if _, ok := reloadableSettings[name]; ok {
+				changed = append(changed, name)
+			} else {
+				ignored = append(ignored, name)
+			}
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(ignored)
+	if len(ignored) > 0 {
+		slog.Warn("settings changed but need a restart", "settings", ignored)
+	}
+	slog.Info("config reloaded", "changed", changed)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	for _, name := range changed {
+		switch name {
+		case "LogLevel":
+			logLevel.Set(logLevels[next.LogLevel])
+		case "MaintenanceMode":
+			// Only a changed setting overrides a toggle made through
+			// /admin/maintenance.
+			s.live.maintenance.Store(next.MaintenanceMode)
+		case "OccupancyCacheTTL", "StaleIfError":
+			s.live.occupancyCache.SetTTL(next.OccupancyCacheTTL, next.StaleIfError)
+		case "NearestCacheTTL":
+			if s.live.nearestCache != nil {
+				s.live.nearestCache.SetTTL(next.NearestCacheTTL, 0)
+			}
+		case "RateLimitRPS", "RateLimitBurst":
+			s.live.limiter.setLimits(next.RateLimitRPS, next.RateLimitBurst)
+		}
+	}
+
+	applied := *prev
+	for name := range reloadableSettings {
+		field := reflect.ValueOf(&applied).Elem().FieldByName(name)
+		field.Set(reflect.ValueOf(next).Elem().FieldByName(name))
+	}
+	s.applied.Store(&applied)
+	return changed
+}
+
+// warnShadowedSettings logs the reloadable settings a reload cannot
+// change because the environment, which is fixed for the life of the
+// process, overrides them in the config file.
+func warnShadowedSettings() {
+	keys := make([]string, 0, len(reloadableSettings))
+	for _, key := range reloadableSettings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if shadowed := shadowedFileKeys(keys); len(shadowed) > 0 {
+		slog.Warn("config file settings overridden by the environment, a reload will not change them", "settings", shadowed)
+	}
+}
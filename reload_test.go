@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadChangesLogLevel(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	logs := captureLogs(t)
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("CONFIG_FILE", file)
+	writeConfig := func(level, port string) {
+		config := "log_level: " + level + "\nadmin_token: secret\nserve_static: false\n" +
+			"bind_address: 127.0.0.1\nfrontend_port: " + port + "\n"
+		if err := os.WriteFile(file, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	port := freePort(t)
+	writeConfig("info", port)
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logLevel.Set(logLevels[cfg.LogLevel])
+	srv := NewServer(cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	// What SIGHUP does. The new port needs a restart and is ignored.
+	writeConfig("debug", freePort(t))
+	reload(srv)
+
+	if got := logLevel.Level(); got != slog.LevelDebug {
+		t.Errorf("log level after reload = %s, want DEBUG", got)
+	}
+	out := logs.String()
+	if !strings.Contains(out, "changed=[LogLevel]") {
+		t.Errorf("reload did not log the changed setting:\n%s", out)
+	}
+	if !strings.Contains(out, "need a restart") || !strings.Contains(out, "FrontendPort") {
+		t.Errorf("reload did not log the ignored port change:\n%s", out)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:"+port+"/debug/config", nil)
+	req.Header.Set("X-Admin-Token", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("server stopped answering on its original port: %v", err)
+	}
+	defer resp.Body.Close()
+	var effective map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&effective); err != nil {
+		t.Fatal(err)
+	}
+	if effective["LogLevel"] != "debug" || effective["FrontendPort"] != port {
+		t.Errorf("/debug/config reports LogLevel %v and FrontendPort %v, want debug and %s",
+			effective["LogLevel"], effective["FrontendPort"], port)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "sync"
+
+const (
+	// retryBudgetInitial lets a fresh gateway retry before any upstream
+	// call has succeeded.
+	retryBudgetInitial = 10
+	// retryBudgetMax caps how many retries quiet periods can save up.
+	retryBudgetMax = 100
+)
+
+// retryBudget is a token bucket shared by every route: each successful
+// upstream call earns ratio tokens and each retry spends one, so during
+// an outage retries stay near ratio of the calls that still succeed. A nil
+// budget allows every retry.
+type retryBudget struct {
+	ratio float64
+
+	mu      sync.Mutex
+	tokens  float64
+	allowed uint64
+	denied  uint64
+}
+
+// newRetryBudget returns a budget for ratio, or nil when ratio is zero.
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio <= 0 {
+		return nil
+	}
+	return &retryBudget{ratio: ratio, tokens: retryBudgetInitial}
+}
+
+// deposit records a successful upstream call.
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetMax)
+	b.mu.Unlock()
+}
+
+// withdraw takes a token for one retry, reporting false when the budget
+// is exhausted.
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		b.denied++
+		return false
+	}
+	b.tokens--
+	b.allowed++
+	return true
+}
+
+// snapshot returns the tokens left and the retries allowed and denied so
+// far.
+func (b *retryBudget) snapshot() (tokens float64, allowed, denied uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens, b.allowed, b.denied
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+type proxyRoute struct {
+	pattern string
+	target  string
+	methods []string
+	// strip, when set, is removed from the request path and the rest is
+	// appended to target.
+	strip string
+}
+
+// routeMethods are the methods a PROXY_ROUTES entry may allow.
+var routeMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true,
+	http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true,
+}
+
+// RegisterProxyRoute mounts a proxy from pattern to target accepting
+// methods, or GET and HEAD when methods is empty, taking every other
+// setting from defaults. A subtree pattern also serves its bare path,
+// which is where API path normalization sends "/api/x/".
+func RegisterProxyRoute(mux *http.ServeMux, pattern, target string, methods []string, defaults Proxy) *Proxy {
+	p := defaults
+	p.Name = path.Base(pattern)
+	p.Target = target
+	p.Methods = methods
+	h := p.Handler()
+	mux.Handle(pattern, h)
+	if bare := strings.TrimSuffix(pattern, "/"); bare != pattern && bare != "" {
+		mux.Handle(bare, h)
+	}
+	return &p
+}
+
+// parseProxyRoutes parses PROXY_ROUTES entries of the form
+// "/pattern=UPSTREAM[/upstream/path] [METHOD,...] [strip=/prefix]"
+// separated by semicolons. UPSTREAM is resolved through upstreams; without
+// an upstream path the pattern itself is appended to the base URL. With
+// strip, each request path minus the prefix is appended instead, so a
+// subtree pattern maps onto the upstream. Without methods the route
+// accepts GET and HEAD. Patterns listed in reserved, and any pattern in
+// reservedTrees, are rejected.
+func parseProxyRoutes(spec string, upstreams map[string]string, reserved []string) ([]proxyRoute, error) {
+	taken := make(map[string]bool, len(reserved))
+	for _, p := range reserved {
+		taken[p] = true
+	}
+
+	var routes []proxyRoute
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, target, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		fields := strings.Fields(target)
+		if !ok || !strings.HasPrefix(pattern, "/") || len(fields) == 0 || len(fields) > 3 {
+			return nil, fmt.Errorf("route %q: expected /pattern=UPSTREAM[/path] [METHOD,...] [strip=/prefix]", entry)
+		}
+		target = fields[0]
+		var methods []string
+		var strip string
+		for _, field := range fields[1:] {
+			if prefix, ok := strings.CutPrefix(field, "strip="); ok {
+				if strip != "" || !strings.HasPrefix(prefix, "/") || !strings.HasPrefix(pattern, prefix) {
+					return nil, fmt.Errorf("route %q: strip=%s must be a prefix of %s", entry, prefix, pattern)
+				}
+				strip = prefix
+				continue
+			}
+			if methods != nil {
+				return nil, fmt.Errorf("route %q: methods listed twice", entry)
+			}
+			for _, m := range strings.Split(field, ",") {
+				m = strings.ToUpper(strings.TrimSpace(m))
+				if !routeMethods[m] {
+					return nil, fmt.Errorf("route %q: unsupported method %q", entry, m)
+				}
+				methods = append(methods, m)
+			}
+		}
+		bare := strings.TrimSuffix(pattern, "/")
+		for _, tree := range reservedTrees {
+			if strings.HasPrefix(pattern, tree) || bare == strings.TrimSuffix(tree, "/") {
+				return nil, fmt.Errorf("route %q: %s is reserved for the gateway", entry, tree)
+			}
+		}
+		if taken[pattern] || taken[bare] {
+			return nil, fmt.Errorf("route %q: pattern %s is already registered", entry, pattern)
+		}
+		taken[pattern], taken[bare] = true, true
+
+		name, upstreamPath, _ := strings.Cut(target, "/")
+		baseURL, ok := upstreams[strings.ToUpper(name)]
+		if !ok || baseURL == "" {
+			return nil, fmt.Errorf("route %q: unknown upstream %q", entry, name)
+		}
+		if upstreamPath == "" && strip == "" {
+			upstreamPath = strings.TrimPrefix(pattern, "/")
+		}
+		routes = append(routes, proxyRoute{
+			pattern: pattern,
+			target:  strings.TrimSuffix(baseURL, "/") + "/" + upstreamPath,
+			methods: methods,
+			strip:   strip,
+		})
+	}
+	return routes, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStripPrefix(t *testing.T) {
+	upstream, last := captureUpstream(t)
+	cfgRoutes, err := parseProxyRoutes("/api/parking/lots/=PARSER/parking/lots strip=/api/parking/lots",
+		map[string]string{"PARSER": upstream.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	route := cfgRoutes[0]
+	defaults := Proxy{Client: &http.Client{}, StripPrefix: route.strip}
+	RegisterProxyRoute(mux, route.pattern, route.target, route.methods, defaults)
+
+	for path, want := range map[string]string{
+		"/api/parking/lots":           "/parking/lots",
+		"/api/parking/lots/":          "/parking/lots/",
+		"/api/parking/lots/42":        "/parking/lots/42",
+		"/api/parking/lots/42/spaces": "/parking/lots/42/spaces",
+		"/api/parking/lots/a%2Fb":     "/parking/lots/a%2Fb",
+	} {
+		if rec := get(mux, path+"?free=1", nil); rec.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", path, rec.Code)
+			continue
+		}
+		if got := last().URL.EscapedPath(); got != want {
+			t.Errorf("%s: upstream path = %q, want %q", path, got, want)
+		}
+		if got := last().URL.RawQuery; got != "free=1" {
+			t.Errorf("%s: upstream query = %q, want free=1", path, got)
+		}
+	}
+}
+
+func TestParseProxyRoutesStrip(t *testing.T) {
+	upstreams := map[string]string{"PARSER": "http://parser:8001"}
+	for spec, wantErr := range map[string]bool{
+		"/api/parking/lots/=PARSER/parking/lots strip=/api/parking/lots": false,
+		"/api/parking/lots/=PARSER strip=/api/parking":                   false,
+		"/api/parking/lots/=PARSER strip=/api/other":                     true,
+		"/api/parking/lots/=PARSER strip=api/parking":                    true,
+		"/api/parking/lots/=PARSER strip=/api strip=/api/parking":        true,
+	} {
+		if _, err := parseProxyRoutes(spec, upstreams, nil); (err != nil) != wantErr {
+			t.Errorf("%q: err = %v, want error %v", spec, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// selfTest writes a report of the effective configuration, secrets
+// redacted, and of one probe of each upstream to w. It reports whether
+// every upstream answered.
+func selfTest(ctx context.Context, w io.Writer, cfg *Config) bool {
+	settings := cfg.effective()
+	fmt.Fprintln(w, "Configuration:")
+	for _, k := range sortedSettings(settings) {
+		fmt.Fprintf(w, "  %-24s %v\n", k, settings[k])
+	}
+
+	upstreams := cfg.upstreamBaseURLs()
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ok := true
+	fmt.Fprintln(w, "Upstreams:")
+	for _, name := range names {
+		baseURL := upstreams[name]
+		if u, err := url.Parse(baseURL); err == nil {
+			baseURL = u.Redacted()
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, readyProbeTimeout)
+		start := time.Now()
+		err := probeUpstream(probeCtx, upstreams[name])
+		elapsed := time.Since(start).Round(time.Millisecond)
+		cancel()
+		if err != nil {
+			ok = false
+			fmt.Fprintf(w, "  %-12s %s  FAIL after %s: %v\n", name, baseURL, elapsed, err)
+			continue
+		}
+		fmt.Fprintf(w, "  %-12s %s  ok in %s\n", name, baseURL, elapsed)
+	}
+	if ok {
+		fmt.Fprintln(w, "Self-test passed.")
+	} else {
+		fmt.Fprintln(w, "Self-test failed.")
+	}
+	return ok
+}
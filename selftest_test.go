@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	withPassword := strings.Replace(healthy.URL, "http://", "http://gateway:hunter2@", 1)
+
+	tests := []struct {
+		name   string
+		epo    string
+		canary string
+		ok     bool
+		lines  []string
+	}{
+		{"all up", healthy.URL, "", true, []string{"epo", "parser", "ok in", "Self-test passed."}},
+		{"epo down", broken.URL, "", false, []string{"epo          " + broken.URL + "  FAIL", "upstream returned 500", "Self-test failed."}},
+		{"canary down", healthy.URL, broken.URL, false, []string{"parser-canary " + broken.URL + "  FAIL", "Self-test failed."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AdminToken = "s3cret-token"
+			cfg.EPOBaseURL = tt.epo
+			cfg.ParserBaseURL = withPassword
+			if tt.canary != "" {
+				cfg.ParserCanaryURL = tt.canary
+				cfg.ParserCanaryWeight = 10
+			}
+			var report strings.Builder
+			if got := selfTest(context.Background(), &report, cfg); got != tt.ok {
+				t.Errorf("selfTest = %v, want %v", got, tt.ok)
+			}
+			out := report.String()
+			for _, line := range tt.lines {
+				if !strings.Contains(out, line) {
+					t.Errorf("report lacks %q:\n%s", line, out)
+				}
+			}
+			for _, secret := range []string{"s3cret-token", "hunter2"} {
+				if strings.Contains(out, secret) {
+					t.Errorf("report shows the secret %q:\n%s", secret, out)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var errUpstreamBusy = errors.New("upstream concurrency limit reached")
+
+// semaphore bounds concurrent upstream calls. A nil semaphore imposes no
+// limit.
+type semaphore struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func newSemaphore(size int, wait time.Duration) *semaphore {
+	return &semaphore{slots: make(chan struct{}, size), wait: wait}
+}
+
+// acquire waits up to s.wait for a free slot, giving up early if ctx ends.
+func (s *semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errUpstreamBusy
+	}
+}
+
+func (s *semaphore) release() {
+	if s != nil {
+		<-s.slots
+	}
+}
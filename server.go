@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+var builtinRoutes = []string{"/api/parking/nearest", "/api/parking/occupancy", "/api/parking/combined", "/api/parking/health"}
+
+// gatewayRoutes are the other patterns the server always registers; "/"
+// is either the static files or the 404 handler.
+var gatewayRoutes = []string{"/", "/metrics", "/healthz", "/readyz", "/version"}
+
+// reservedTrees are the subtrees kept for the admin and debug endpoints,
+// whether or not they are enabled.
+var reservedTrees = []string{"/admin/", "/debug/"}
+
+// Server is the gateway's HTTP server together with the steps that
+// prepare it.
+type Server struct {
+	cfg      *Config
+	metrics  *metrics
+	srv      *http.Server
+	serveErr chan error
+	// applied is cfg with the reloadable settings last applied; a reload
+	// swaps it.
+	applied atomic.Pointer[Config]
+	live    *liveSettings
+}
+
+// NewServer returns a gateway for cfg. Nothing is set up until Start.
+func NewServer(cfg *Config) *Server {
+	s := &Server{cfg: cfg, metrics: proxyMetrics, serveErr: make(chan error, 1)}
+	s.applied.Store(cfg)
+	return s
+}
+
+// Start validates the configuration, checks the static directory, builds
+// the routes with their caches, registers their metrics and starts
+// listening, in that order, returning the error of the first step that
+// fails. Errors while serving are reported on Err.
+func (s *Server) Start() error {
+	if problems := s.cfg.validate(); len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	if s.cfg.ServeStatic {
+		if err := checkStaticDir(s.cfg.StaticDir); err != nil {
+			if s.cfg.ServeStaticStrict {
+				return fmt.Errorf("STATIC_DIR: %w", err)
+			}
+			slog.Warn("static directory unusable, static requests will 404", "dir", s.cfg.StaticDir, "err", err)
+		}
+	}
+	srv, routes, live, err := newHTTPServer(s.cfg, &s.applied)
+	if err != nil {
+		return err
+	}
+	s.srv, s.live = srv, live
+	if err := s.metrics.register(routes); err != nil {
+		srv.Shutdown(context.Background())
+		return fmt.Errorf("metrics: %w", err)
+	}
+	if s.cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		if err != nil {
+			srv.Shutdown(context.Background())
+			return fmt.Errorf("tls: %w", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		srv.Shutdown(context.Background())
+		return err
+	}
+	go func() {
+		if srv.TLSConfig != nil {
+			s.serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		s.serveErr <- srv.Serve(ln)
+	}()
+	return nil
+}
+
+// Err delivers the error that stopped serving; after Shutdown it is
+// http.ErrServerClosed.
+func (s *Server) Err() <-chan error {
+	return s.serveErr
+}
+
+// Shutdown stops the server gracefully, waiting for in-flight requests
+// until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+// newHTTPServer wires the gateway's routes and middleware for cfg and
+// returns the route names their metrics are recorded under, along with
+// the settings a reload can change. /debug/config reports applied.
+func newHTTPServer(cfg *Config, applied *atomic.Pointer[Config]) (*http.Server, []string, *liveSettings, error) {
+	client := newUpstreamClient(cfg)
+	defaults := Proxy{
+		Client:           client,
+		MaxRetries:       cfg.UpstreamMaxRetries,
+		RetryJitter:      cfg.RetryJitter,
+		RetryBudget:      newRetryBudget(cfg.RetryBudgetRatio),
+		CORS:             newCORSPolicy(cfg.AllowedOrigins),
+		TrustForwarded:   cfg.TrustProxyHeaders,
+		RequestIDHeader:  cfg.RequestIDHeader,
+		MaxResponseBytes: cfg.MaxResponseBytes,
+		ForwardAuth:      cfg.ForwardAuth,
+		SlowThreshold:    cfg.SlowRequestThreshold,
+		MaxRequestBytes:  cfg.MaxRequestBytes,
+		EnforceJSON:      cfg.EnforceJSON,
+		Timeout:          cfg.UpstreamTimeout,
+		ForwardHeaders:   cfg.ForwardHeaders,
+	}
+
+	// newCacheStore returns the backend for the cache called name; the
+	// size limit only applies in memory.
+	newCacheStore := func(name string, maxEntries int) cacheBackend {
+		return newMemoryCache(maxEntries)
+	}
+	if cfg.CacheBackend == "redis" {
+		redis, err := newRedisClient(cfg.RedisURL)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+		newCacheStore = func(name string, _ int) cacheBackend {
+			return newRedisCache(redis, "parking-gateway:"+name+":")
+		}
+	}
+
+	parserProxy := defaults
+	parserProxy.Name = "nearest"
+	parserProxy.Methods = []string{http.MethodGet, http.MethodHead}
+	var parserTargets []string
+	for _, base := range cfg.parserBaseURLs() {
+		parserTargets = append(parserTargets, strings.TrimSuffix(base, "/")+cfg.ParserNearestPath)
+	}
+	parserProxy.Target = parserTargets[0]
+	if len(parserTargets) > 1 {
+		parserProxy.Pool = newUpstreamPool(parserTargets, upstreamCooldown)
+	}
+	parserProxy.Breaker = newCircuitBreaker("parser", cfg.BreakerThreshold, cfg.BreakerCooldown)
+	parserProxy.Limit = newSemaphore(cfg.ParserMaxConcurrency, concurrencyWait)
+	parserProxy.ValidateQuery = validateNearest
+	// Results are filtered by bbox before fields can drop their
+	// coordinates, and projected before units are converted so clients
+	// name the upstream's metre fields.
+	parserProxy.AddTransformer(bboxTransformer{})
+	parserProxy.AddTransformer(fieldsTransformer{})
+	parserProxy.AddTransformer(unitsTransformer{})
+	parserProxy.DefaultQuery = cfg.ParserDefaultQuery
+	parserProxy.AllowedParams = cfg.NearestAllowedParams
+	parserProxy.HostOverride = cfg.ParserHostOverride
+	parserProxy.BasicAuth = cfg.ParserBasicAuth
+	if cfg.ParserTimeout > 0 {
+		parserProxy.Timeout = cfg.ParserTimeout
+	}
+	if cfg.NearestCacheSize > 0 {
+		parserProxy.Cache = newResponseCache(cfg.NearestCacheTTL, 0, newCacheStore("nearest", cfg.NearestCacheSize))
+	}
+
+	epoProxy := defaults
+	epoProxy.Name = "occupancy"
+	epoProxy.Methods = []string{http.MethodGet, http.MethodHead}
+	epoProxy.Target = strings.TrimSuffix(cfg.EPOBaseURL, "/") + cfg.EPOOccupancyPath
+	epoProxy.Breaker = newCircuitBreaker("epo", cfg.BreakerThreshold, cfg.BreakerCooldown)
+	epoProxy.Limit = newSemaphore(cfg.EPOMaxConcurrency, concurrencyWait)
+	epoProxy.Cache = newResponseCache(cfg.OccupancyCacheTTL, cfg.StaleIfError, newCacheStore("occupancy", 0))
+	epoProxy.Coalesce = &flightGroup{}
+	if cfg.ValidateJSON {
+		epoProxy.AddTransformer(jsonValidator{})
+	}
+	epoProxy.HostOverride = cfg.EPOHostOverride
+	epoProxy.BasicAuth = cfg.EPOBasicAuth
+	if cfg.EPOTimeout > 0 {
+		epoProxy.Timeout = cfg.EPOTimeout
+	}
+
+	if cfg.CoordPrecision >= 0 {
+		parserProxy.NormalizeQuery = snapCoordinates(cfg.CoordPrecision)
+		epoProxy.NormalizeQuery = parserProxy.NormalizeQuery
+	}
+	if cfg.ParserCanaryWeight > 0 {
+		// The canary is a separate instance: it gets its own breaker and
+		// concurrency limit, and its responses are never cached or shared.
+		canary := parserProxy
+		canary.Target = strings.TrimSuffix(cfg.ParserCanaryURL, "/") + cfg.ParserNearestPath
+		canary.Pool, canary.Cache, canary.Coalesce = nil, nil, nil
+		canary.Breaker = newCircuitBreaker("parser-canary", cfg.BreakerThreshold, cfg.BreakerCooldown)
+		canary.Limit = newSemaphore(cfg.ParserMaxConcurrency, concurrencyWait)
+		parserProxy.Canary = &canary
+		parserProxy.CanaryWeight = cfg.ParserCanaryWeight
+	}
+
+	// ctx stops background work when the server shuts down.
+	ctx, cancel := context.WithCancel(context.Background())
+	mux := http.NewServeMux()
+	routes := []string{parserProxy.Name, epoProxy.Name}
+	if cfg.MockMode {
+		mux.Handle("/api/parking/nearest", mockHandler(cfg.MockDir, parserProxy.Name))
+		mux.Handle("/api/parking/occupancy", mockHandler(cfg.MockDir, epoProxy.Name))
+		mux.Handle("/api/parking/combined", mockHandler(cfg.MockDir, "combined"))
+		for _, route := range cfg.Routes {
+			name := path.Base(route.pattern)
+			mux.Handle(route.pattern, mockHandler(cfg.MockDir, name))
+			routes = append(routes, name)
+		}
+	} else {
+		mux.Handle("/api/parking/nearest", parserProxy.Handler())
+		mux.Handle("/api/parking/occupancy", epoProxy.Handler())
+		mux.Handle("/api/parking/combined", combinedHandler(&parserProxy, &epoProxy, combinedBudget(cfg.RequestTimeout)))
+		for _, route := range cfg.Routes {
+			routeDefaults := defaults
+			routeDefaults.Breaker = newCircuitBreaker(route.pattern, cfg.BreakerThreshold, cfg.BreakerCooldown)
+			routeDefaults.StripPrefix = route.strip
+			p := RegisterProxyRoute(mux, route.pattern, route.target, route.methods, routeDefaults)
+			routes = append(routes, p.Name)
+		}
+	}
+	proxyMetrics.setRetryBudget(defaults.RetryBudget)
+	mux.Handle("/metrics", proxyMetrics)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle("/readyz", readyzHandler(cfg.upstreamBaseURLs()))
+	mux.Handle("/api/parking/health", newHealthProber(ctx, cfg.upstreamBaseURLs(), cfg.HealthInterval))
+	if cfg.Warmup && !cfg.MockMode {
+		go warmUpstreams(ctx, client, cfg.upstreamBaseURLs())
+	}
+	var maintenance atomic.Bool
+	maintenance.Store(cfg.MaintenanceMode)
+	if cfg.AdminToken != "" {
+		mux.Handle("/admin/maintenance", requireAdminToken(cfg.AdminToken, maintenanceHandler(&maintenance)))
+		caches := map[string]*responseCache{"occupancy": epoProxy.Cache}
+		if parserProxy.Cache != nil {
+			caches["nearest"] = parserProxy.Cache
+		}
+		mux.Handle("/admin/cache/flush", requireAdminToken(cfg.AdminToken, cacheFlushHandler(caches)))
+		mux.Handle("/debug/config", requireAdminToken(cfg.AdminToken, configHandler(applied)))
+		if cfg.EnablePprof {
+			mux.Handle("/debug/pprof/", requireAdminToken(cfg.AdminToken, pprofHandler()))
+		}
+	}
+	if cfg.ServeStatic {
+		mux.Handle(cfg.StaticPrefix, http.StripPrefix(strings.TrimSuffix(cfg.StaticPrefix, "/"), staticHandler(cfg.StaticDir, cfg.SPAFallback)))
+	}
+	if !cfg.ServeStatic || cfg.StaticPrefix != "/" {
+		mux.Handle("/", http.NotFoundHandler())
+	}
+
+	limiter := newRateLimiter(ctx, cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.TrustProxyHeaders)
+
+	var accessLog, tracing, compression Middleware
+	if offered := compressionOffers[cfg.CompressionAlgo]; offered != nil {
+		compression = func(next http.Handler) http.Handler { return withCompression(offered, cfg.CompressionLevel, next) }
+	}
+	if cfg.AccessLogFile != "" {
+		out, err := openRotatingFile(cfg.AccessLogFile, int64(cfg.AccessLogMaxMB)<<20)
+		if err != nil {
+			cancel()
+			return nil, nil, nil, fmt.Errorf("access log: %w", err)
+		}
+		accessLog = func(next http.Handler) http.Handler { return withAccessLog(out, next) }
+	}
+	if cfg.OTLPEndpoint != "" {
+		t := newTracer(ctx, cfg.OTLPEndpoint, cfg.OTELServiceName)
+		tracing = func(next http.Handler) http.Handler { return withTracing(t, next) }
+	}
+
+	// Outermost first. The in-flight gauge and request ID cover every
+	// request. Logging wraps recovery and compression so it records the
+	// status and size the client actually got, and sees host redirects.
+	// Path normalization runs before the request timeout, the maintenance
+	// check and the rate limiter, which need the canonical /api/ path.
+	handler := Chain(mux,
+		func(next http.Handler) http.Handler { return withInflight(proxyMetrics, next) },
+		func(next http.Handler) http.Handler { return withRequestID(cfg.RequestIDHeader, next) },
+		accessLog,
+		func(next http.Handler) http.Handler {
+			return withLogging(slog.Default(), cfg.LogSampleRate, cfg.SlowRequestThreshold, next)
+		},
+		func(next http.Handler) http.Handler {
+			return withCanonicalHost(cfg.CanonicalHost, cfg.TrustProxyHeaders, next)
+		},
+		tracing,
+		compression,
+		withRecovery,
+		func(next http.Handler) http.Handler { return withAPIPathNormalization(cfg.LowercaseAPIPaths, next) },
+		func(next http.Handler) http.Handler { return withRequestTimeout(cfg.RequestTimeout, next) },
+		func(next http.Handler) http.Handler { return withMaintenance(&maintenance, next) },
+		limiter.wrap,
+	)
+
+	srv := &http.Server{
+		Addr:              cfg.listenAddr(),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(cancel)
+	live := &liveSettings{
+		maintenance:    &maintenance,
+		occupancyCache: epoProxy.Cache,
+		nearestCache:   parserProxy.Cache,
+		limiter:        limiter,
+	}
+	return srv, routes, live, nil
+}
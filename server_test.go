@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer builds the gateway's handler for cfg, serving static files
+// from a temporary directory holding files.
+func newTestServer(t *testing.T, cfg *Config, files map[string]string) http.Handler {
+	t.Helper()
+	cfg.StaticDir = t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(cfg.StaticDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var applied atomic.Pointer[Config]
+	applied.Store(cfg)
+	srv, _, _, err := newHTTPServer(cfg, &applied)
+	if err != nil {
+		t.Fatalf("newHTTPServer: %v", err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return srv.Handler
+}
+
+func TestMaintenanceBlocksAPIButServesStatic(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaintenanceMode = true
+	h := newTestServer(t, cfg, map[string]string{
+		"index.html":       "<div id=app></div>",
+		"maintenance.html": "<h1>Back soon</h1>",
+	})
+
+	rec := get(h, "/api/parking/nearest?lat=55.75&lng=37.61", nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("API status = %d, want 503", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("API response has no Retry-After")
+	}
+	if got := errorCode(rec.Body.Bytes()); got != errCodeMaintenance {
+		t.Errorf("error code = %q, want %q", got, errCodeMaintenance)
+	}
+
+	for _, path := range []string{"/", "/maintenance.html"} {
+		if rec := get(h, path, nil); rec.Code != http.StatusOK {
+			t.Errorf("static %s status = %d, want 200", path, rec.Code)
+		}
+	}
+}
+
+func TestStartFailsOnBadMetricsRegistration(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ServeStatic = false
+	// Named "nearest" after its last segment, like the built-in route.
+	cfg.Routes = []proxyRoute{{pattern: "/api/v2/nearest", target: "http://127.0.0.1:8001/v2/nearest"}}
+	s := NewServer(cfg)
+	defer s.Shutdown(context.Background())
+
+	err := s.Start()
+	if err == nil {
+		t.Fatal("Start succeeded with two routes named nearest")
+	}
+	if !strings.Contains(err.Error(), "metrics") {
+		t.Errorf("Start error = %q, want a metrics error", err)
+	}
+}
+
+// logBuffer collects log output from concurrent goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the default logger's output, at every level, to the
+// returned buffer for the rest of the test.
+func captureLogs(t *testing.T) *logBuffer {
+	buf := &logBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return buf
+}
+
+// freePort returns a TCP port on the loopback interface nothing listens on.
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestStartChecksStaticDir(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		logs := captureLogs(t)
+		cfg := DefaultConfig()
+		cfg.BindAddress, cfg.FrontendPort = "127.0.0.1", freePort(t)
+		cfg.StaticDir = filepath.Join(t.TempDir(), "missing")
+		cfg.ServeStaticStrict = strict
+		s := NewServer(cfg)
+		err := s.Start()
+		s.Shutdown(context.Background())
+
+		if strict {
+			if err == nil || !strings.Contains(err.Error(), "STATIC_DIR") {
+				t.Errorf("strict: Start error = %v, want a STATIC_DIR error", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		if out := logs.String(); !strings.Contains(out, "level=WARN") || !strings.Contains(out, "static directory unusable") {
+			t.Errorf("no warning for a missing static dir in:\n%s", out)
+		}
+	}
+}
+
+func TestRequestTimeoutCoversNormalizedPaths(t *testing.T) {
+	cfg := DefaultConfig()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Health probes get their answer at once.
+		if r.URL.Path != cfg.ParserNearestPath {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer upstream.Close()
+	cfg.ParserBaseURL = upstream.URL
+	cfg.RequestTimeout = 50 * time.Millisecond
+	cfg.LowercaseAPIPaths = true
+	h := newTestServer(t, cfg, nil)
+
+	for _, path := range []string{"/api/parking/nearest", "/API/Parking/Nearest/"} {
+		if rec := get(h, path+"?lat=55.75&lng=37.61", nil); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status = %d, want 503", path, rec.Code)
+		}
+	}
+}
+
+func TestPprofEndpoints(t *testing.T) {
+	token := http.Header{"X-Admin-Token": {"secret"}}
+	for _, enabled := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.ServeStatic = false
+		cfg.AdminToken = "secret"
+		cfg.EnablePprof = enabled
+		h := newTestServer(t, cfg, nil)
+
+		for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+			anonymous, authorized := get(h, path, nil).Code, get(h, path, token).Code
+			if !enabled {
+				if anonymous != http.StatusNotFound || authorized != http.StatusNotFound {
+					t.Errorf("disabled %s: status %d without token, %d with; want 404", path, anonymous, authorized)
+				}
+				continue
+			}
+			if anonymous != http.StatusUnauthorized {
+				t.Errorf("enabled %s without token: status = %d, want 401", path, anonymous)
+			}
+			if authorized != http.StatusOK {
+				t.Errorf("enabled %s with token: status = %d, want 200", path, authorized)
+			}
+		}
+	}
+}
+
+func TestCustomUpstreamPaths(t *testing.T) {
+	// A base URL with a trailing slash must not double the path's.
+	for _, suffix := range []string{"", "/"} {
+		var mu sync.Mutex
+		paths := map[string]bool{}
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths[r.URL.Path] = true
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+		}))
+		defer upstream.Close()
+		cfg := loadTestConfig(t, map[string]string{
+			"PARSER_BASE_URL":     upstream.URL + suffix,
+			"EPO_BASE_URL":        upstream.URL + suffix,
+			"PARSER_NEAREST_PATH": "/v2/lots/nearest",
+			"EPO_OCCUPANCY_PATH":  "/epo/occupancy/now",
+		})
+		cfg.ServeStatic = false
+		h := newTestServer(t, cfg, nil)
+
+		for _, path := range []string{"/api/parking/nearest?lat=55.75&lng=37.61", "/api/parking/occupancy"} {
+			if rec := get(h, path, nil); rec.Code != http.StatusOK {
+				t.Errorf("base URL %q, %s: status = %d, want 200", upstream.URL+suffix, path, rec.Code)
+			}
+		}
+		mu.Lock()
+		for _, want := range []string{"/v2/lots/nearest", "/epo/occupancy/now"} {
+			if !paths[want] {
+				t.Errorf("base URL %q: upstream never saw %s, only %v", upstream.URL+suffix, want, paths)
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+func TestRepeatedParamsReachUpstream(t *testing.T) {
+	nearest := DefaultConfig().ParserNearestPath
+	queries := make(chan url.Values, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == nearest {
+			queries <- r.URL.Query()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+	cfg := loadTestConfig(t, map[string]string{
+		"PARSER_BASE_URL":        upstream.URL,
+		"NEAREST_ALLOWED_PARAMS": "lat,lng,lot",
+		"PARSER_DEFAULT_QUERY":   "lot=Z&source=frontend",
+		"COORD_PRECISION":        "3",
+	})
+	cfg.ServeStatic = false
+	h := newTestServer(t, cfg, nil)
+
+	rec := get(h, "/api/parking/nearest?lat=55.75123&lng=37.61789&lot=A&lot=B&debug=1", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	got := <-queries
+	want := url.Values{
+		"lat":    {"55.751"},
+		"lng":    {"37.618"},
+		"lot":    {"A", "B"},
+		"source": {"frontend"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream query = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "sync"
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val *bufferedResponse
+	err error
+}
+
+// flightGroup collapses concurrent calls with the same key into a single
+// execution whose result is shared by every caller.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+func (g *flightGroup) Do(key string, fn func() (*bufferedResponse, error)) (*bufferedResponse, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const eventStreamType = "text/event-stream"
+
+func isEventStream(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == eventStreamType
+}
+
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), eventStreamType)
+}
+
+// copyFlushing relays body to w, flushing after every read so server-sent
+// events reach the client as they arrive. It returns when the upstream
+// closes the stream or the client goes away, which cancels the upstream
+// request and fails the next read. Streams are exempt from the server's
+// write timeout.
+func copyFlushing(w http.ResponseWriter, body io.Reader) error {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	buf := make([]byte, 4096)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := rc.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProxyFlushesEventsAsTheyArrive(t *testing.T) {
+	next := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", eventStreamType)
+		for i := 1; i <= 2; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer upstream.Close()
+	gateway := httptest.NewServer(newTestProxy(upstream.URL).Handler())
+	defer gateway.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, gateway.URL, nil)
+	req.Header.Set("Accept", eventStreamType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if sc.Text() != "" {
+				lines <- sc.Text()
+			}
+		}
+		close(lines)
+	}()
+	for i := 1; i <= 2; i++ {
+		select {
+		case line := <-lines:
+			if want := fmt.Sprintf("data: %d", i); line != want {
+				t.Fatalf("event %d = %q, want %q", i, line, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %d was not flushed while the stream was open", i)
+		}
+		next <- struct{}{}
+	}
+}
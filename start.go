@@ -1,77 +1,163 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"log/slog"
 	"net/http"
 	"os"
-)
-
-var (
-	frontendPort  = envOr("FRONTEND_PORT", "12300")
-	parserBaseURL = envOr("PARSER_BASE_URL", "http://127.0.0.1:8001")
-	epoBaseURL    = envOr("EPO_BASE_URL", "http://127.0.0.1:5000")
-	staticDir     = envOr("STATIC_DIR", "./public")
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 )
 
 func main() {
-	http.HandleFunc("/api/parking/nearest", func(w http.ResponseWriter, r *http.Request) {
-		proxyGet(w, r, parserBaseURL+"/parking/nearest")
-	})
+	check := flag.Bool("check", false, "validate the configuration, probe the upstreams and exit")
+	flag.Parse()
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *check || cfg.SelfTest {
+		if !selfTest(context.Background(), os.Stdout, cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+	logLevel.Set(logLevels[cfg.LogLevel])
+	slog.SetDefault(newLogger(cfg.LogFormat, &logLevel))
 
-	http.HandleFunc("/api/parking/occupancy", func(w http.ResponseWriter, r *http.Request) {
-		proxyGet(w, r, epoBaseURL+"/api/parking/occupancy")
-	})
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	http.Handle("/", http.FileServer(http.Dir(staticDir)))
+	if cfg.WaitForUpstreams {
+		err := waitForUpstreams(ctx, cfg.upstreamBaseURLs(), cfg.StartupTimeout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "startup failed:", err)
+			os.Exit(1)
+		}
+	}
 
-	fmt.Println("Server is listening on port", frontendPort+".")
-	fmt.Println("Parser base URL:", parserBaseURL)
-	fmt.Println("EPO base URL:", epoBaseURL)
-	if err := http.ListenAndServe(":"+frontendPort, nil); err != nil {
-		fmt.Println("server error:", err)
+	srv := NewServer(cfg)
+	if err := srv.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, "startup failed:", err)
+		os.Exit(1)
 	}
-}
 
-func proxyGet(w http.ResponseWriter, r *http.Request, target string) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+	listening := "port " + cfg.FrontendPort
+	if cfg.BindAddress != "" {
+		listening = cfg.listenAddr()
 	}
+	if cfg.TLSCertFile != "" {
+		fmt.Println("Server is listening on", listening, "with TLS.")
+	} else {
+		fmt.Println("Server is listening on", listening+".")
+	}
+	logStartup(cfg)
 
-	proxyURL := target
-	if r.URL.RawQuery != "" {
-		proxyURL += "?" + r.URL.RawQuery
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+wait:
+	for {
+		select {
+		case err := <-srv.Err():
+			if !errors.Is(err, http.ErrServerClosed) {
+				fmt.Println("server error:", err)
+				os.Exit(1)
+			}
+			return
+		case <-hup:
+			reload(srv)
+		case <-ctx.Done():
+			break wait
+		}
 	}
 
-	req, err := http.NewRequest(http.MethodGet, proxyURL, nil)
+	fmt.Println("Shutting down, draining in-flight requests for up to", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	start := time.Now()
+	go logDrain(shutdownCtx)
+	err = srv.Shutdown(shutdownCtx)
+	slog.Info("drain finished", "duration_ms", time.Since(start).Milliseconds(), "inflight", proxyMetrics.inflight.Load())
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+		fmt.Println("shutdown error:", err)
 		return
 	}
-	req.Header.Set("Accept", "application/json")
+	fmt.Println("Shutdown complete.")
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// reload re-reads the config file and applies what can change while
+// serving. The environment cannot change under a running process, so it
+// still overrides the file. An invalid configuration is logged and leaves
+// the running settings alone.
+func reload(srv *Server) {
+	next, err := LoadConfig()
 	if err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+		slog.Error("config reload failed", "err", err)
 		return
 	}
-	defer resp.Body.Close()
+	warnShadowedSettings()
+	srv.Reload(next)
+}
+
+// logStartup records the effective configuration, secrets redacted, as a
+// single log line.
+func logStartup(cfg *Config) {
+	settings := cfg.effective()
+	keys := sortedSettings(settings)
+	args := make([]any, 0, 2*len(keys))
+	for _, k := range keys {
+		args = append(args, k, settings[k])
+	}
+	slog.Info("startup", args...)
+}
+
+func sortedSettings(settings map[string]any) []string {
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
+// logDrain reports the in-flight request count every second until ctx is
+// done.
+func logDrain(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			slog.Info("draining", "inflight", proxyMetrics.inflight.Load())
 		}
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+// logLevel is the level of the default logger; a reload changes it.
+var logLevel slog.LevelVar
 
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+// logLevels maps LOG_LEVEL values to slog levels.
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
 }
 
-func envOr(key, fallback string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+func newLogger(format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts))
 	}
-	return fallback
+	return slog.New(slog.NewTextHandler(os.Stdout, opts))
 }
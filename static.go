@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// hashedAsset matches fingerprinted file names such as app.3f9a1c2b.js.
+var hashedAsset = regexp.MustCompile(`\.[0-9a-f]{8,}\.`)
+
+// staticHandler serves files from dir with Cache-Control set per file.
+// With spaFallback, GET requests for client-side routes that match no file
+// get index.html instead of a 404; missing assets (paths with a file
+// extension) and API paths still 404. Static misses are answered with
+// dir/404.html when it exists.
+func staticHandler(dir string, spaFallback bool) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if f, err := http.Dir(dir).Open(name); err == nil {
+			f.Close()
+			w.Header().Set("Cache-Control", staticCacheControl(name))
+			files.ServeHTTP(w, r)
+			return
+		}
+
+		if !spaFallback || (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+			strings.HasPrefix(r.URL.Path, "/api/") || path.Ext(name) != "" {
+			if !strings.HasPrefix(r.URL.Path, "/api/") && serveNotFoundPage(w, r, dir) {
+				return
+			}
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, filepath.Join(dir, "index.html"))
+	})
+}
+
+// checkStaticDir reports why dir cannot be served as the static root.
+func checkStaticDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// serveNotFoundPage writes dir/404.html with a 404 status. It reports
+// false, having written nothing, when the page is missing or the request
+// is not a GET or HEAD.
+func serveNotFoundPage(w http.ResponseWriter, r *http.Request, dir string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	f, err := http.Dir(dir).Open("/404.html")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+	return true
+}
+
+func staticCacheControl(name string) string {
+	base := path.Base(name)
+	switch {
+	case name == "/" || base == "index.html":
+		return "no-cache"
+	case hashedAsset.MatchString(base):
+		return "public, max-age=31536000, immutable"
+	}
+	return "public, max-age=3600"
+}
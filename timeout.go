@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// withRequestTimeout answers 503 when an API request has not started its
+// response within timeout. The handler keeps running with a cancelled
+// context, but nothing it writes afterwards reaches the client. Event
+// streams are exempt, and a response that has begun is never cut off.
+func withRequestTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || wantsEventStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		tw := &timeoutWriter{w: w, header: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case p := <-panicked:
+			panic(p)
+		case <-ctx.Done():
+			if tw.timeout() {
+				slog.Warn("request timed out", "request_id", requestIDFrom(r.Context()), "path", r.URL.Path, "timeout", timeout)
+				return
+			}
+			// The response has started; let the handler finish it.
+			select {
+			case <-done:
+			case p := <-panicked:
+				panic(p)
+			}
+		}
+	})
+}
+
+// timeoutWriter keeps the handler's headers to itself until it writes, so
+// the timeout response never races with them.
+type timeoutWriter struct {
+	w      http.ResponseWriter
+	header http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(status)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(status int) {
+	if tw.wroteHeader || tw.timedOut {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.timedOut {
+		http.NewResponseController(tw.w).Flush()
+	}
+}
+
+// timeout writes the 503 unless the response has already started, and
+// reports whether it did.
+func (tw *timeoutWriter) timeout() bool {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.wroteHeader {
+		return false
+	}
+	tw.timedOut = true
+	writeJSONError(tw.w, http.StatusServiceUnavailable, errCodeRequestTimeout, "request took too long")
+	return true
+}
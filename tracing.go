@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing emits OpenTelemetry spans over OTLP/HTTP with JSON encoding and
+// propagates W3C trace context. It is only enabled when
+// OTEL_EXPORTER_OTLP_ENDPOINT is set.
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+	traceQueueSize     = 2048
+)
+
+// tracer batches finished spans and exports them until its context is
+// done, then makes one best-effort flush. A nil tracer records nothing.
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *span
+}
+
+func newTracer(ctx context.Context, endpoint, service string) *tracer {
+	t := &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  service,
+		client:   &http.Client{Timeout: 5 * time.Second},
+		queue:    make(chan *span, traceQueueSize),
+	}
+	go t.run(ctx)
+	return t
+}
+
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	failed   bool
+
+	mu sync.Mutex
+}
+
+type spanKey struct{}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startClientSpan starts a child of the server span in ctx, or returns nil
+// when the request is not traced.
+func startClientSpan(ctx context.Context, name string) *span {
+	parent := spanFrom(ctx)
+	if parent == nil {
+		return nil
+	}
+	s := &span{
+		tracer:   parent.tracer,
+		traceID:  parent.traceID,
+		parentID: parent.spanID,
+		name:     name,
+		kind:     spanKindClient,
+		start:    time.Now(),
+		attrs:    map[string]any{},
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+func (s *span) setError() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.failed = true
+	s.mu.Unlock()
+}
+
+// inject writes the traceparent header for calls made under s.
+func (s *span) inject(h http.Header) {
+	if s == nil {
+		return
+	}
+	h.Set("Traceparent", fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])))
+}
+
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+		// Drop spans rather than block requests when the exporter lags.
+	}
+}
+
+// parseTraceparent extracts the trace and parent span IDs from a W3C
+// traceparent header.
+func parseTraceparent(v string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceID, parentID, false
+	}
+	if n, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || n != len(traceID) || traceID == [16]byte{} {
+		return traceID, parentID, false
+	}
+	if n, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || n != len(parentID) || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// withTracing records a server span for every request, continuing the
+// caller's trace when a valid traceparent header is present.
+func withTracing(t *tracer, next http.Handler) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &span{
+			tracer: t,
+			name:   r.Method + " " + spanRoute(r.URL.Path),
+			kind:   spanKindServer,
+			start:  time.Now(),
+			attrs: map[string]any{
+				"http.request.method": r.Method,
+				"url.path":            r.URL.Path,
+			},
+		}
+		if traceID, parentID, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			s.traceID, s.parentID = traceID, parentID
+		} else {
+			rand.Read(s.traceID[:])
+		}
+		rand.Read(s.spanID[:])
+
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			s.setAttr("http.response.status_code", status)
+			if status >= 500 {
+				s.setError()
+			}
+			s.finish()
+		}()
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+	})
+}
+
+// spanRoute keeps span names low-cardinality: API and service endpoints
+// are named by path, everything else is static content.
+func spanRoute(p string) string {
+	switch {
+	case strings.HasPrefix(p, "/api/"), p == "/metrics", p == "/healthz", p == "/readyz", p == "/version":
+		return p
+	default:
+		return "static"
+	}
+}
+
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(ctx, batch); err != nil {
+			slog.Warn("trace export failed", "endpoint", t.endpoint, "spans", len(batch), "err", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		case <-ctx.Done():
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			flushCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			flush(flushCtx)
+			cancel()
+			return
+		}
+	}
+}
+
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func otlpAttrs(attrs map[string]any) []otlpAttr {
+	out := make([]otlpAttr, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]any
+		switch v := v.(type) {
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, otlpAttr{Key: k, Value: value})
+	}
+	return out
+}
+
+// export sends spans as one OTLP ExportTraceServiceRequest.
+func (t *tracer) export(ctx context.Context, batch []*span) error {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttrs(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failed {
+			out["status"] = map[string]any{"code": spanStatusError}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttrs(map[string]any{"service.name": t.service}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "parking-gateway"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ResponseTransformer post-processes a buffered upstream response body
+// for the request r. It may also adjust header, the response header sent
+// to the client. An error stops the chain and the client gets a 502. A
+// Proxy without transformers relays bodies unchanged.
+type ResponseTransformer interface {
+	Transform(r *http.Request, body []byte, header http.Header) ([]byte, error)
+}
+
+// TransformerFunc adapts a function to ResponseTransformer.
+type TransformerFunc func(r *http.Request, body []byte, header http.Header) ([]byte, error)
+
+func (f TransformerFunc) Transform(r *http.Request, body []byte, header http.Header) ([]byte, error) {
+	return f(r, body, header)
+}
+
+// paramTransformer is a ResponseTransformer the client asks for with the
+// query parameter Param. The parameter is the gateway's own: it passes
+// AllowedParams, is never sent upstream, and responses to requests
+// without it skip the transformer.
+type paramTransformer interface {
+	ResponseTransformer
+	Param() string
+}
+
+// AddTransformer appends t to the transformers run for p.
+func (p *Proxy) AddTransformer(t ResponseTransformer) {
+	// Proxies are copied from shared defaults; never append in place.
+	p.Transformers = append(p.Transformers[:len(p.Transformers):len(p.Transformers)], t)
+}
+
+// transformersFor returns the transformers that apply to r.
+func (p *Proxy) transformersFor(r *http.Request) []ResponseTransformer {
+	var active []ResponseTransformer
+	for _, t := range p.Transformers {
+		if pt, ok := t.(paramTransformer); ok && r.URL.Query().Get(pt.Param()) == "" {
+			continue
+		}
+		active = append(active, t)
+	}
+	return active
+}
+
+// gatewayParams names the query parameters p's transformers read.
+func (p *Proxy) gatewayParams() []string {
+	var names []string
+	for _, t := range p.Transformers {
+		if pt, ok := t.(paramTransformer); ok {
+			names = append(names, pt.Param())
+		}
+	}
+	return names
+}
+
+// transforms reports whether a response to r with status and header goes
+// through the transformers.
+func (p *Proxy) transforms(r *http.Request, status int, header http.Header) bool {
+	return len(p.transformersFor(r)) > 0 && status >= 200 && status <= 299 &&
+		status != http.StatusNoContent && decodable(header)
+}
+
+// decodable reports whether a body with header can be read as plain bytes,
+// possibly after gunzipping it.
+func decodable(header http.Header) bool {
+	enc := header.Get("Content-Encoding")
+	return enc == "" || strings.EqualFold(enc, "gzip")
+}
+
+// decodeBody gunzips a gzip-encoded body so it can be transformed, updating
+// header to describe the plain body. withCompression compresses it again
+// for clients that accept it.
+func (p *Proxy) decodeBody(body []byte, header http.Header) ([]byte, error) {
+	if !strings.EqualFold(header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var plain io.Reader = zr
+	if p.MaxResponseBytes > 0 {
+		plain = io.LimitReader(zr, p.MaxResponseBytes+1)
+	}
+	out, err := io.ReadAll(plain)
+	if err != nil {
+		return nil, err
+	}
+	if p.MaxResponseBytes > 0 && int64(len(out)) > p.MaxResponseBytes {
+		return nil, fmt.Errorf("decoded body exceeds %d bytes", p.MaxResponseBytes)
+	}
+	header.Del("Content-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(out)))
+	// The validator described the encoded bytes.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	return out, nil
+}
+
+// transform runs the transformers for r over body in order, keeping the
+// Content-Length and ETag in header consistent with the result.
+func (p *Proxy) transform(r *http.Request, body []byte, header http.Header) ([]byte, error) {
+	body, err := p.decodeBody(body, header)
+	if err != nil {
+		slog.Warn("response decode failed", "route", p.Name, "err", err)
+		return nil, fmt.Errorf("%w: %w", errTransformFailed, err)
+	}
+	out := body
+	for _, t := range p.transformersFor(r) {
+		var err error
+		if out, err = t.Transform(r, out, header); err != nil {
+			slog.Warn("response transform failed", "route", p.Name, "err", err)
+			return nil, fmt.Errorf("%w: %w", errTransformFailed, err)
+		}
+	}
+	if !bytes.Equal(out, body) {
+		header.Del("ETag")
+		header.Set("Content-Length", strconv.Itoa(len(out)))
+	}
+	return out, nil
+}
+
+// jsonValidator rejects bodies that claim to be JSON but do not parse, such
+// as a response the upstream cut short.
+type jsonValidator struct{}
+
+func (jsonValidator) Transform(_ *http.Request, body []byte, header http.Header) ([]byte, error) {
+	if isJSONContentType(header.Get("Content-Type")) && !json.Valid(body) {
+		return nil, errInvalidJSON
+	}
+	return body, nil
+}
+
+func isJSONContentType(v string) bool {
+	mediaType, _, err := mime.ParseMediaType(v)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
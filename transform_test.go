@@ -0,0 +1,132 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// suffix returns a transformer appending s to the body.
+func suffix(s string) TransformerFunc {
+	return func(_ *http.Request, body []byte, _ http.Header) ([]byte, error) {
+		return append(body, s...), nil
+	}
+}
+
+func jsonUpstream(t *testing.T, body string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTransformersRunInOrder(t *testing.T) {
+	p := newTestProxy(jsonUpstream(t, "body").URL)
+	p.AddTransformer(suffix("-a"))
+	p.AddTransformer(suffix("-b"))
+
+	rec := get(p.Handler(), "/api/nearest", nil)
+	if got := rec.Body.String(); got != "body-a-b" {
+		t.Errorf("body = %q, want %q", got, "body-a-b")
+	}
+	if got := rec.Header().Get("Content-Length"); got != "8" {
+		t.Errorf("Content-Length = %q, want 8", got)
+	}
+}
+
+func TestTransformerErrorStopsTheChain(t *testing.T) {
+	p := newTestProxy(jsonUpstream(t, `{}`).URL)
+	p.AddTransformer(TransformerFunc(func(*http.Request, []byte, http.Header) ([]byte, error) {
+		return nil, errors.New("boom")
+	}))
+	ran := false
+	p.AddTransformer(TransformerFunc(func(_ *http.Request, body []byte, _ http.Header) ([]byte, error) {
+		ran = true
+		return body, nil
+	}))
+
+	rec := get(p.Handler(), "/api/nearest", nil)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if ran {
+		t.Error("transformer after the failing one ran")
+	}
+}
+
+func TestJSONValidator(t *testing.T) {
+	for body, want := range map[string]int{
+		`{"lots":[]}`: http.StatusOK,
+		`{"lots":[`:   http.StatusBadGateway,
+	} {
+		p := newTestProxy(jsonUpstream(t, body).URL)
+		p.AddTransformer(jsonValidator{})
+		if rec := get(p.Handler(), "/api/occupancy", nil); rec.Code != want {
+			t.Errorf("body %q: status = %d, want %d", body, rec.Code, want)
+		}
+	}
+}
+
+func TestProxyWithoutTransformersRelaysUnchanged(t *testing.T) {
+	p := newTestProxy(jsonUpstream(t, `{"a": 1}`).URL)
+	if got := get(p.Handler(), "/api/nearest", nil).Body.String(); got != `{"a": 1}` {
+		t.Errorf("body = %q, want it unchanged", got)
+	}
+}
+
+func TestTransformersSeeGunzippedBody(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"abc"`)
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, `{"distance_m":100}`)
+		zw.Close()
+	}))
+	defer upstream.Close()
+	p := newTestProxy(upstream.URL)
+	// Keep the transport from decoding the body before the proxy does.
+	p.Client = &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	p.AddTransformer(unitsTransformer{})
+
+	rec := get(p.Handler(), "/api/nearest?units=imperial", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Body.String(); got != `{"distance_ft":328}` {
+		t.Errorf("body = %q, want the converted plain JSON", got)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Errorf("Content-Encoding = %q, want none", enc)
+	}
+	if etag := rec.Header().Get("ETag"); etag != "" {
+		t.Errorf("ETag = %q, want it dropped for the changed body", etag)
+	}
+}
+
+func TestFieldsTransformer(t *testing.T) {
+	const body = `{"total_found":1,"parking":[{"name":"A","distance_m":120,"lots":5,"address":"Tverskaya 1"}]}`
+	p := newTestProxy(jsonUpstream(t, body).URL)
+	p.AddTransformer(fieldsTransformer{})
+
+	for query, want := range map[string]string{
+		"":                                body,
+		"?fields=":                        body,
+		"?fields=,,":                      body,
+		"?fields=name,lots":               `{"parking":[{"lots":5,"name":"A"}],"total_found":1}`,
+		"?fields=name,%20distance_m,nope": `{"parking":[{"distance_m":120,"name":"A"}],"total_found":1}`,
+	} {
+		rec := get(p.Handler(), "/api/parking/nearest"+query, nil)
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: status = %d, want 200", query, rec.Code)
+		}
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%q: body = %s, want %s", query, got, want)
+		}
+	}
+}
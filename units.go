@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+)
+
+const (
+	feetPerMeter = 3.28084
+	feetPerMile  = 5280
+	// Distances of at least this many feet are reported in miles.
+	imperialMileThresholdFt = 1000
+)
+
+// unitsTransformer converts metre distances in nearest results to
+// imperial units when the client asks for units=imperial.
+type unitsTransformer struct{}
+
+func (unitsTransformer) Param() string { return "units" }
+
+func (unitsTransformer) Transform(r *http.Request, body []byte, _ http.Header) ([]byte, error) {
+	if r.URL.Query().Get("units") != "imperial" {
+		return body, nil
+	}
+	return toImperial(body)
+}
+
+func toImperial(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return json.Marshal(convertDistances(doc))
+}
+
+// convertDistances replaces every distance*_m field with distance*_ft, or
+// distance*_mi for long distances.
+func convertDistances(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			n, ok := val.(json.Number)
+			if !ok || !strings.HasPrefix(key, "distance") || !strings.HasSuffix(key, "_m") {
+				v[key] = convertDistances(val)
+				continue
+			}
+			meters, err := n.Float64()
+			if err != nil {
+				continue
+			}
+			delete(v, key)
+			base := strings.TrimSuffix(key, "_m")
+			if ft := meters * feetPerMeter; ft < imperialMileThresholdFt {
+				v[base+"_ft"] = math.Round(ft)
+			} else {
+				v[base+"_mi"] = math.Round(ft/feetPerMile*100) / 100
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = convertDistances(val)
+		}
+	}
+	return v
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// validateCoordinates checks the point for a nearest-parking search and
+// returns the names of missing or invalid parameters. The point is given
+// either as coordinates=lat,lng (what the frontend sends) or as separate
+// lat and lng parameters.
+func validateCoordinates(q url.Values) []string {
+	if q.Has("coordinates") {
+		lat, lng, ok := strings.Cut(q.Get("coordinates"), ",")
+		if !ok || !inRange(lat, 90) || !inRange(lng, 180) {
+			return []string{"coordinates"}
+		}
+		return nil
+	}
+
+	var invalid []string
+	if !inRange(q.Get("lat"), 90) {
+		invalid = append(invalid, "lat")
+	}
+	if !inRange(q.Get("lng"), 180) {
+		invalid = append(invalid, "lng")
+	}
+	return invalid
+}
+
+// validateNearest checks a nearest-parking query: the point plus the
+// optional units and bbox parameters.
+func validateNearest(q url.Values) []string {
+	invalid := validateCoordinates(q)
+	if q.Has("units") {
+		if u := q.Get("units"); u != "metric" && u != "imperial" {
+			invalid = append(invalid, "units")
+		}
+	}
+	if q.Has("bbox") {
+		if _, ok := parseBBox(q.Get("bbox")); !ok {
+			invalid = append(invalid, "bbox")
+		}
+	}
+	return invalid
+}
+
+func inRange(raw string, limit float64) bool {
+	v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	return err == nil && v >= -limit && v <= limit
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+)
+
+// Set at build time with -ldflags "-X main.buildCommit=... -X main.buildTime=...".
+var buildCommit, buildTime string
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"commit":     orUnknown(buildCommit),
+		"build_time": orUnknown(buildTime),
+		"go_version": runtime.Version(),
+	})
+}
+
+func orUnknown(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}